@@ -0,0 +1,345 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNotOwner is returned when an advisory lock is released by an owner that
+// does not hold it.
+var ErrNotOwner = errors.New("advisory lock not held by owner")
+
+// ErrUpgradeConflict is returned when a shared advisory lock is upgraded
+// while another owner is already waiting to upgrade its shared lock on the
+// same path. Waiting as well would deadlock both owners.
+var ErrUpgradeConflict = errors.New("advisory lock upgrade already pending")
+
+// ErrNoOwner is returned when an advisory lock is requested with a context
+// that carries no Owner.
+var ErrNoOwner = errors.New("no lock owner in context")
+
+// Owner identifies the holder of advisory locks. Operations performed with a
+// context carrying an Owner are admitted past the advisory locks that Owner
+// holds, so a lock holder can keep using the filesystem without deadlocking
+// against itself. The zero Owner identifies no one.
+type Owner struct {
+	id uint64
+}
+
+var lastOwner atomic.Uint64
+
+// NewOwner returns a new, unique Owner.
+func NewOwner() Owner {
+	return Owner{id: lastOwner.Add(1)}
+}
+
+type ownerKey struct{}
+
+// WithOwner returns a copy of ctx carrying o.
+func WithOwner(ctx context.Context, o Owner) context.Context {
+	return context.WithValue(ctx, ownerKey{}, o)
+}
+
+// OwnerFromContext returns the Owner carried by ctx, or the zero Owner if
+// there is none.
+func OwnerFromContext(ctx context.Context) Owner {
+	o, _ := ctx.Value(ownerKey{}).(Owner)
+	return o
+}
+
+// pathLock is the advisory lock state of a single path.
+type pathLock struct {
+	owner  Owner         // exclusive holder
+	depth  int           // exclusive acquisitions by owner
+	shared map[Owner]int // shared acquisitions per owner
+	wake   chan struct{} // closed whenever the lock is released
+
+	upgrader Owner // owner waiting to upgrade its shared lock, if any
+}
+
+func (l *pathLock) free() bool {
+	return l.depth == 0 && len(l.shared) == 0
+}
+
+// admits reports whether o may take the lock, exclusively if excl is set,
+// or perform an operation of that kind on the path. Locks held by o itself
+// never get in the way.
+func (l *pathLock) admits(o Owner, excl bool) bool {
+	if l.depth > 0 && l.owner != o {
+		return false
+	}
+	if excl {
+		for holder := range l.shared {
+			if holder != o {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// advisory is the table of advisory locks held on paths.
+type advisory struct {
+	mu    sync.Mutex
+	paths map[string]*pathLock
+	held  atomic.Int64 // number of entries in paths
+}
+
+// active reports whether any advisory lock is held.
+func (t *advisory) active() bool {
+	return t.held.Load() > 0
+}
+
+// blocked returns a channel to wait on if an operation by o on keys is
+// held back by another owner's lock, and nil otherwise. Mutations are held
+// back by locks on the named paths and anything beneath them, as they may
+// remove or move whole trees.
+func (t *advisory) blocked(o Owner, mutation bool, keys []string) <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for held, l := range t.paths {
+		for _, key := range keys {
+			if held != key && !(mutation && within(held, key)) {
+				continue
+			}
+			if !l.admits(o, mutation) {
+				return l.wake
+			}
+		}
+	}
+	return nil
+}
+
+// acquire takes the lock on key for o, waiting until it is admitted.
+func (t *advisory) acquire(ctx context.Context, o Owner, key string, excl bool) error {
+	for {
+		t.mu.Lock()
+		if t.paths == nil {
+			t.paths = make(map[string]*pathLock)
+		}
+		l := t.paths[key]
+		if l == nil {
+			l = &pathLock{wake: make(chan struct{})}
+			t.paths[key] = l
+			t.held.Add(1)
+		}
+		pending := !excl && l.upgrader != (Owner{}) && l.upgrader != o
+		if !pending && l.admits(o, excl) {
+			if excl {
+				l.owner = o
+				l.depth++
+			} else {
+				if l.shared == nil {
+					l.shared = make(map[Owner]int)
+				}
+				l.shared[o]++
+			}
+			t.mu.Unlock()
+			return nil
+		}
+		wait := l.wake
+		t.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			// The entry may have been created for this attempt only.
+			t.mu.Lock()
+			t.forget(key, t.paths[key])
+			t.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+// release drops one acquisition of the lock on key by o.
+func (t *advisory) release(o Owner, key string, excl bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.paths[key]
+	switch {
+	case l == nil:
+		return ErrNotOwner
+	case excl:
+		if l.depth == 0 || l.owner != o {
+			return ErrNotOwner
+		}
+		l.depth--
+		if l.depth == 0 {
+			l.owner = Owner{}
+		}
+	default:
+		if l.shared[o] == 0 {
+			return ErrNotOwner
+		}
+		l.shared[o]--
+		if l.shared[o] == 0 {
+			delete(l.shared, o)
+		}
+	}
+	t.signal(l)
+	t.forget(key, l)
+	return nil
+}
+
+// upgrade turns one of o's shared acquisitions of the lock on key into an
+// exclusive one, waiting until o is the only owner holding the lock. New
+// shared acquisitions by other owners wait while the upgrade is pending.
+func (t *advisory) upgrade(ctx context.Context, o Owner, key string) error {
+	t.mu.Lock()
+	l := t.paths[key]
+	switch {
+	case l == nil || l.shared[o] == 0:
+		t.mu.Unlock()
+		return ErrNotOwner
+	case l.upgrader != (Owner{}):
+		t.mu.Unlock()
+		return ErrUpgradeConflict
+	}
+	l.upgrader = o
+	for !l.admits(o, true) {
+		wait := l.wake
+		t.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			t.mu.Lock()
+			l.upgrader = Owner{}
+			t.signal(l)
+			t.mu.Unlock()
+			return ctx.Err()
+		}
+		t.mu.Lock()
+	}
+	l.upgrader = Owner{}
+	l.shared[o]--
+	if l.shared[o] == 0 {
+		delete(l.shared, o)
+	}
+	l.owner = o
+	l.depth++
+	t.mu.Unlock()
+	return nil
+}
+
+// downgrade turns one of o's exclusive acquisitions of the lock on key into
+// a shared one. The lock is never free in between.
+func (t *advisory) downgrade(o Owner, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.paths[key]
+	if l == nil || l.depth == 0 || l.owner != o {
+		return ErrNotOwner
+	}
+	l.depth--
+	if l.depth == 0 {
+		l.owner = Owner{}
+	}
+	if l.shared == nil {
+		l.shared = make(map[Owner]int)
+	}
+	l.shared[o]++
+	t.signal(l)
+	return nil
+}
+
+// signal wakes everyone waiting on l. The caller must hold t.mu.
+func (t *advisory) signal(l *pathLock) {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// forget drops the entry for key once l is no longer held. The caller must
+// hold t.mu.
+func (t *advisory) forget(key string, l *pathLock) {
+	if l != nil && l.free() && t.paths[key] == l {
+		delete(t.paths, key)
+		t.held.Add(-1)
+		t.signal(l)
+	}
+}
+
+// lockPath implements the exported advisory lock methods.
+func (c *core) lockPath(ctx context.Context, op, name string, excl bool) error {
+	o := OwnerFromContext(ctx)
+	if o == (Owner{}) {
+		return &os.PathError{Op: op, Path: name, Err: ErrNoOwner}
+	}
+	return c.advisory.acquire(ctx, o, c.key(name), excl)
+}
+
+// unlockPath implements the exported advisory unlock methods.
+func (c *core) unlockPath(ctx context.Context, op, name string, excl bool) error {
+	key := c.key(name)
+	if err := c.advisory.release(OwnerFromContext(ctx), key, excl); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// key returns the key of name while holding the filesystem read lock.
+func (c *core) key(name string) string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.abs(name)
+}
+
+// LockPath takes an exclusive advisory lock on name for the Owner carried by
+// ctx, waiting until no other owner holds a lock on it. The lock is
+// reentrant: an owner may take it again and must release it as many times.
+// While the lock is held, operations on name (or, for mutations, on any
+// parent of name) by other owners wait for its release, while those
+// performed through a WithContext view carrying the same Owner, and through
+// files opened by it, are admitted.
+func (c *core) LockPath(ctx context.Context, name string) error {
+	return c.lockPath(ctx, "lock", name, true)
+}
+
+// RLockPath takes a shared advisory lock on name for the Owner carried by
+// ctx, waiting until no other owner holds the exclusive lock. While the lock
+// is held, mutations of name by other owners wait for its release.
+func (c *core) RLockPath(ctx context.Context, name string) error {
+	return c.lockPath(ctx, "rlock", name, false)
+}
+
+// UnlockPath releases an exclusive advisory lock on name taken by LockPath.
+// It returns ErrNotOwner, wrapped in a *PathError, if the Owner carried by
+// ctx does not hold the lock.
+func (c *core) UnlockPath(ctx context.Context, name string) error {
+	return c.unlockPath(ctx, "unlock", name, true)
+}
+
+// RUnlockPath releases a shared advisory lock on name taken by RLockPath.
+// It returns ErrNotOwner, wrapped in a *PathError, if the Owner carried by
+// ctx does not hold the lock.
+func (c *core) RUnlockPath(ctx context.Context, name string) error {
+	return c.unlockPath(ctx, "runlock", name, false)
+}
+
+// UpgradePath atomically turns a shared advisory lock on name, taken by
+// RLockPath, into an exclusive one. It waits until the Owner carried by ctx
+// is the only owner holding the lock, and the lock is held shared for the
+// whole wait, so no other owner can modify name in between. If another owner
+// is already waiting to upgrade its lock on name, UpgradePath fails at once
+// with ErrUpgradeConflict and the shared lock is still held. Either way the
+// error is wrapped in a *PathError.
+func (c *core) UpgradePath(ctx context.Context, name string) error {
+	if err := c.advisory.upgrade(ctx, OwnerFromContext(ctx), c.key(name)); err != nil {
+		return &os.PathError{Op: "upgrade", Path: name, Err: err}
+	}
+	return nil
+}
+
+// DowngradePath atomically turns an exclusive advisory lock on name, taken by
+// LockPath or UpgradePath, into a shared one, admitting other readers
+// without ever releasing the lock. The shared lock is released with
+// RUnlockPath.
+func (c *core) DowngradePath(ctx context.Context, name string) error {
+	if err := c.advisory.downgrade(OwnerFromContext(ctx), c.key(name)); err != nil {
+		return &os.PathError{Op: "downgrade", Path: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+)
+
+func newAdvisoryFS(t *testing.T) *FileSystem {
+	t.Helper()
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(mfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Create("/locked.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	f.Close()
+	return fsys
+}
+
+// TestAdvisoryLockReentrant tests that the holder of an exclusive advisory
+// lock can keep operating on the locked path.
+func TestAdvisoryLockReentrant(t *testing.T) {
+	fsys := newAdvisoryFS(t)
+	ctx := WithOwner(context.Background(), NewOwner())
+
+	if err := fsys.LockPath(ctx, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.LockPath(ctx, "/locked.txt"); err != nil {
+		t.Fatalf("reentrant lock: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		view := fsys.WithContext(ctx)
+		if _, err := view.Stat("/locked.txt"); err != nil {
+			done <- err
+			return
+		}
+		f, err := view.OpenFile("/locked.txt", os.O_RDWR, 0644)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer f.Close()
+		_, err = f.Write([]byte("more"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lock holder deadlocked against its own lock")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := fsys.UnlockPath(ctx, "/locked.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsys.UnlockPath(ctx, "/locked.txt"); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner after full release, got %v", err)
+	}
+}
+
+// TestAdvisoryLockBlocksOthers tests that operations by other owners wait
+// for an exclusive advisory lock to be released.
+func TestAdvisoryLockBlocksOthers(t *testing.T) {
+	fsys := newAdvisoryFS(t)
+	ctx := WithOwner(context.Background(), NewOwner())
+
+	if err := fsys.LockPath(ctx, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := fsys.WithContext(timeout).Stat("/locked.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Stat to wait for the lock, got %v", err)
+	}
+
+	// Unrelated paths are not affected.
+	if _, err := fsys.Create("/other.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := fsys.Stat("/locked.txt")
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := fsys.UnlockPath(ctx, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stat did not proceed after unlock")
+	}
+}
+
+// TestAdvisoryLockShared tests shared advisory locks.
+func TestAdvisoryLockShared(t *testing.T) {
+	fsys := newAdvisoryFS(t)
+	a := WithOwner(context.Background(), NewOwner())
+	b := WithOwner(context.Background(), NewOwner())
+
+	if err := fsys.RLockPath(a, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RLockPath(b, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads by anyone are admitted.
+	if _, err := fsys.ReadFile("/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mutations by others wait, including those of the parent tree.
+	timeout, cancel := context.WithTimeout(a, 20*time.Millisecond)
+	defer cancel()
+	if err := fsys.WithContext(timeout).Chmod("/locked.txt", 0600); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Chmod to wait for b's lock, got %v", err)
+	}
+	if err := fsys.WithContext(timeout).RemoveAll("/"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected RemoveAll to wait for the locks, got %v", err)
+	}
+
+	if err := fsys.RUnlockPath(b, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WithContext(a).Chmod("/locked.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RUnlockPath(a, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAdvisoryUnlockErrors tests that misuse of advisory locks is reported
+// as an error.
+func TestAdvisoryUnlockErrors(t *testing.T) {
+	fsys := newAdvisoryFS(t)
+	a := WithOwner(context.Background(), NewOwner())
+	b := WithOwner(context.Background(), NewOwner())
+
+	if err := fsys.LockPath(context.Background(), "/locked.txt"); !errors.Is(err, ErrNoOwner) {
+		t.Fatalf("expected ErrNoOwner, got %v", err)
+	}
+
+	if err := fsys.LockPath(a, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+	err := fsys.UnlockPath(b, "/locked.txt")
+	if !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner, got %v", err)
+	}
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "/locked.txt" {
+		t.Fatalf("expected *os.PathError for /locked.txt, got %#v", err)
+	}
+	if err := fsys.RUnlockPath(a, "/locked.txt"); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner for shared unlock, got %v", err)
+	}
+	if err := fsys.UnlockPath(a, "locked.txt"); err != nil {
+		t.Fatalf("relative unlock: %v", err)
+	}
+}
+
+// TestAdvisoryUpgrade tests upgrading a shared advisory lock.
+func TestAdvisoryUpgrade(t *testing.T) {
+	fsys := newAdvisoryFS(t)
+	a := WithOwner(context.Background(), NewOwner())
+	b := WithOwner(context.Background(), NewOwner())
+
+	if err := fsys.UpgradePath(a, "/locked.txt"); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner without a shared lock, got %v", err)
+	}
+
+	for _, ctx := range []context.Context{a, b} {
+		if err := fsys.RLockPath(ctx, "/locked.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upgraded := make(chan error, 1)
+	go func() {
+		upgraded <- fsys.UpgradePath(a, "/locked.txt")
+	}()
+
+	// Wait for a's upgrade to become pending; b's must conflict with it.
+	for pending := false; !pending; time.Sleep(time.Millisecond) {
+		fsys.advisory.mu.Lock()
+		pending = fsys.advisory.paths["/locked.txt"].upgrader != (Owner{})
+		fsys.advisory.mu.Unlock()
+	}
+	if err := fsys.UpgradePath(b, "/locked.txt"); !errors.Is(err, ErrUpgradeConflict) {
+		t.Fatalf("expected ErrUpgradeConflict, got %v", err)
+	}
+
+	select {
+	case err := <-upgraded:
+		t.Fatalf("upgrade completed while b still holds a shared lock: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := fsys.RUnlockPath(b, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-upgraded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upgrade did not complete")
+	}
+
+	timeout, cancel := context.WithTimeout(b, 20*time.Millisecond)
+	defer cancel()
+	if _, err := fsys.WithContext(timeout).Stat("/locked.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected reads to wait for the upgraded lock, got %v", err)
+	}
+	if err := fsys.UnlockPath(a, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAdvisoryDowngrade tests downgrading an exclusive advisory lock.
+func TestAdvisoryDowngrade(t *testing.T) {
+	fsys := newAdvisoryFS(t)
+	a := WithOwner(context.Background(), NewOwner())
+	b := WithOwner(context.Background(), NewOwner())
+
+	if err := fsys.DowngradePath(a, "/locked.txt"); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner without a lock, got %v", err)
+	}
+	if err := fsys.LockPath(a, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.DowngradePath(a, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other owners may now read and share the lock, but not write.
+	if _, err := fsys.WithContext(b).ReadFile("/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RLockPath(b, "/locked.txt"); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(b, 20*time.Millisecond)
+	defer cancel()
+	if err := fsys.WithContext(timeout).Remove("/locked.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Remove to wait for a's shared lock, got %v", err)
+	}
+
+	if err := fsys.UnlockPath(a, "/locked.txt"); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner for the released exclusive lock, got %v", err)
+	}
+	for _, ctx := range []context.Context{a, b} {
+		if err := fsys.RUnlockPath(ctx, "/locked.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
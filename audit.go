@@ -0,0 +1,75 @@
+package lockfs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying principal, which identifies
+// who performs the operations made through a WithContext view using it in
+// the audit log.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal carried by ctx, or "" if it
+// carries none.
+func PrincipalFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey{}).(string)
+	return p
+}
+
+// AuditRecord is a line of the audit log written by wrappers created with
+// WithAudit. It describes one mutating call, whether it succeeded or not.
+// Arguments that do not apply to the operation are omitted.
+type AuditRecord struct {
+	Time      time.Time    `json:"time"`
+	Principal string       `json:"principal,omitempty"`
+	Op        string       `json:"op"`
+	Path      string       `json:"path"`
+	NewPath   string       `json:"new_path,omitempty"`
+	Flag      *int         `json:"flag,omitempty"`
+	Mode      *os.FileMode `json:"mode,omitempty"`
+	UID       *int         `json:"uid,omitempty"`
+	GID       *int         `json:"gid,omitempty"`
+	Atime     *time.Time   `json:"atime,omitempty"`
+	Mtime     *time.Time   `json:"mtime,omitempty"`
+	Size      *int64       `json:"size,omitempty"`
+	Offset    *int64       `json:"offset,omitempty"`
+	Gen       *uint64      `json:"gen,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// auditLog writes AuditRecords to an io.Writer as JSON lines.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// audit records a mutating call made on behalf of the principal carried by
+// ctx, which failed with *errp if it is not nil, in the audit log. Errors
+// writing the audit log are ignored.
+func (c *core) audit(ctx context.Context, errp *error, rec AuditRecord) {
+	log := c.auditLog
+	if log == nil {
+		return
+	}
+	rec.Time = time.Now()
+	rec.Principal = PrincipalFromContext(ctx)
+	if *errp != nil {
+		rec.Error = (*errp).Error()
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.enc.Encode(rec)
+}
+
+func int64ptr(n int) *int64 {
+	v := int64(n)
+	return &v
+}
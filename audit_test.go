@@ -0,0 +1,86 @@
+package lockfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+// readAudit decodes the records in an audit log.
+func readAudit(t *testing.T, buf *bytes.Buffer) []AuditRecord {
+	t.Helper()
+	var records []AuditRecord
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("bad audit line %q: %v", sc.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// TestAudit tests that mutating calls, and only those, are recorded with
+// their arguments, principal and result.
+func TestAudit(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	fsys, err := NewFS(mfs, WithAudit(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := fsys.WithContext(WithPrincipal(fsys.ctx, "alice"))
+
+	if err := alice.Mkdir("/dir", 0750); err != nil {
+		t.Fatal(err)
+	}
+	f, err := alice.Create("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	if err := fsys.Chown("/dir/file.txt", 1000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	fsys.SetReadOnly(true)
+	fsys.Rename("/dir/file.txt", "/dir/other.txt")
+
+	records := readAudit(t, &buf)
+	if len(records) != 5 {
+		t.Fatalf("expected 5 records, got %+v", records)
+	}
+
+	mkdir := records[0]
+	if mkdir.Op != "mkdir" || mkdir.Path != "/dir" || mkdir.Principal != "alice" || mkdir.Mode == nil || *mkdir.Mode != 0750 || mkdir.Error != "" || mkdir.Time.IsZero() {
+		t.Errorf("unexpected mkdir record %+v", mkdir)
+	}
+	if open := records[1]; open.Op != "open" || open.Flag == nil || *open.Flag&os.O_CREATE == 0 || open.Principal != "alice" {
+		t.Errorf("unexpected open record %+v", open)
+	}
+	if write := records[2]; write.Op != "write" || write.Path != "/dir/file.txt" || write.Size == nil || *write.Size != 5 || write.Principal != "alice" {
+		t.Errorf("unexpected write record %+v", write)
+	}
+	if chown := records[3]; chown.Op != "chown" || chown.UID == nil || *chown.UID != 1000 || chown.GID == nil || *chown.GID != 0 || chown.Principal != "" {
+		t.Errorf("unexpected chown record %+v", chown)
+	}
+	rename := records[4]
+	if rename.Op != "rename" || rename.Path != "/dir/file.txt" || rename.NewPath != "/dir/other.txt" {
+		t.Errorf("unexpected rename record %+v", rename)
+	}
+	if rename.Error != (&os.LinkError{Op: "rename", Old: "/dir/file.txt", New: "/dir/other.txt", Err: syscall.EROFS}).Error() {
+		t.Errorf("expected the failure to be recorded, got %q", rename.Error)
+	}
+}
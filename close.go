@@ -0,0 +1,81 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// ErrClosed is returned by operations on a wrapper that has been closed.
+var ErrClosed = errors.New("filesystem closed")
+
+// Close shuts the wrapper down. Operations started after Close is called,
+// other than those on files that are already open, fail with ErrClosed.
+// Close then waits for the operations in progress to complete, so no write
+// is in progress once it returns.
+//
+// Files that are still open are closed by Close, after which operations on
+// them fail with os.ErrClosed. If the wrapper was created with WithDrainFiles,
+// Close first waits for them to be closed until ctx is done, and returns
+// ctx.Err() if it had to close any of them itself. Otherwise, Close returns
+// the errors from closing the files. Closing a closed wrapper returns
+// ErrClosed. Closing a frozen wrapper thaws it. Close also stops all watches,
+// and makes pending waits for paths fail with ErrClosed.
+func (c *core) Close(ctx context.Context) error {
+	c.m.Lock()
+	closed := c.closed
+	c.closed = true
+	c.unfreeze()
+	c.versions.reset()
+	c.m.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	c.watchers.cancelAll()
+	c.gens.wakeAll()
+
+	var err error
+	if c.drainFiles {
+		err = c.drain(ctx)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	return errors.Join(err, c.closeFiles())
+}
+
+// drain waits until no file is open or ctx is done.
+func (c *core) drain(ctx context.Context) error {
+	for {
+		wait := c.handles.busy("/", true)
+		if wait == nil {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// closeFiles closes all open files. The caller must hold the filesystem
+// write lock, so no operation on the files is in progress.
+func (c *core) closeFiles() error {
+	var errs []error
+	for _, f := range c.handles.all() {
+		if err := f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ensureOpen returns ErrClosed if the wrapper has been closed. The caller must
+// hold the filesystem lock.
+func (c *core) ensureOpen() error {
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
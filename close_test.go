@@ -0,0 +1,139 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestClose tests that a closed wrapper rejects new operations and closes
+// the files still open.
+func TestClose(t *testing.T) {
+	fsys := newShareFS(t)
+
+	f, err := fsys.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fsys.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fsys.Stat("/dir/file.txt"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Stat: expected ErrClosed, got %v", err)
+	}
+	if _, err := fsys.Create("/new.txt"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Create: expected ErrClosed, got %v", err)
+	}
+	if err := fsys.Remove("/dir/file.txt"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Remove: expected ErrClosed, got %v", err)
+	}
+	if _, err := f.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("File.Stat: expected os.ErrClosed, got %v", err)
+	}
+	if err := f.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("File.Close: expected os.ErrClosed, got %v", err)
+	}
+	if err := fsys.Close(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("second Close: expected ErrClosed, got %v", err)
+	}
+}
+
+// TestCloseWaitsForOperations tests that Close waits for operations in
+// progress.
+func TestCloseWaitsForOperations(t *testing.T) {
+	fsys := newShareFS(t)
+
+	// Simulate an operation in progress.
+	fsys.rlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fsys.Close(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Close returned during an operation: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	fsys.runlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+// TestCloseDrainFiles tests that Close waits for open files to be closed when
+// created with WithDrainFiles.
+func TestCloseDrainFiles(t *testing.T) {
+	fsys := newShareFS(t, WithDrainFiles())
+
+	f, err := fsys.OpenFile("/dir/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fsys.Close(context.Background())
+	}()
+
+	// New operations fail while draining, but open files remain usable.
+	for {
+		_, err := fsys.Stat("/dir/file.txt")
+		if errors.Is(err, ErrClosed) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := f.Write([]byte("last words")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Close returned with a file open: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the file was closed")
+	}
+}
+
+// TestCloseDrainTimeout tests that Close closes the remaining files once its
+// context is done.
+func TestCloseDrainTimeout(t *testing.T) {
+	fsys := newShareFS(t, WithDrainFiles())
+
+	f, err := fsys.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := fsys.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected os.ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package lockfs
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// contentCache is a least-recently-used cache of the contents of regular
+// files, keyed by path and generation. Mutations made through the wrapper
+// advance the generation of the paths they affect, so entries for older
+// generations are never served, and are dropped when looked up or evicted.
+// Mutations through symbolic links do not advance the generation of the
+// files they change, so they reset the cache.
+type contentCache struct {
+	max int64 // bytes of contents the cache may hold
+
+	mu    sync.Mutex
+	epoch uint64 // counts resets, so contents read before one are not cached
+	size  int64
+	lru   list.List // of *contentEntry, most recently used first
+	paths map[string]*list.Element
+}
+
+// contentEntry is a file held in a contentCache.
+type contentEntry struct {
+	key  string
+	gen  uint64
+	file *savedEntry
+}
+
+// get returns the file cached for key at generation gen, or nil.
+func (cc *contentCache) get(key string, gen uint64) *savedEntry {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	el := cc.paths[key]
+	if el == nil {
+		return nil
+	}
+	e := el.Value.(*contentEntry)
+	if e.gen != gen {
+		cc.remove(el)
+		return nil
+	}
+	cc.lru.MoveToFront(el)
+	return e.file
+}
+
+// current returns the number of resets so far, to cache contents read from
+// then on with.
+func (cc *contentCache) current() uint64 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.epoch
+}
+
+// reset drops all cached contents.
+func (cc *contentCache) reset() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.epoch++
+	cc.paths = nil
+	cc.lru.Init()
+	cc.size = 0
+}
+
+// put caches file as the contents of key at generation gen, read since reset
+// epoch, evicting the least recently used files as needed.
+func (cc *contentCache) put(key string, gen, epoch uint64, file *savedEntry) {
+	size := int64(len(file.data))
+	if size > cc.max {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if epoch != cc.epoch {
+		return
+	}
+	if cc.paths == nil {
+		cc.paths = make(map[string]*list.Element)
+	}
+	if el := cc.paths[key]; el != nil {
+		if el.Value.(*contentEntry).gen > gen {
+			return
+		}
+		cc.remove(el)
+	}
+	for cc.size+size > cc.max {
+		cc.remove(cc.lru.Back())
+	}
+	cc.paths[key] = cc.lru.PushFront(&contentEntry{key: key, gen: gen, file: file})
+	cc.size += size
+}
+
+// remove drops el from the cache. The caller must hold cc.mu.
+func (cc *contentCache) remove(el *list.Element) {
+	e := cc.lru.Remove(el).(*contentEntry)
+	delete(cc.paths, e.key)
+	cc.size -= int64(len(e.file.data))
+}
+
+// cachedReadFile is ReadFile on the wrapped filesystem, served from the
+// content cache if there is one. The caller must hold the filesystem lock.
+func (c *core) cachedReadFile(name string) ([]byte, error) {
+	if c.content == nil {
+		return c.base.ReadFile(name)
+	}
+	key := c.abs(name)
+	if !c.direct(key, true) {
+		return c.base.ReadFile(name)
+	}
+	gen, epoch := c.gens.get(key), c.content.current()
+	if file := c.content.get(key, gen); file != nil {
+		return cloneBytes(file.data), nil
+	}
+	info, err := c.cachedStat(name)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > c.content.max {
+		return c.base.ReadFile(name)
+	}
+	data, err := c.base.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c.content.put(key, gen, epoch, &savedEntry{info: snapshotInfo(info), data: data})
+	return cloneBytes(data), nil
+}
+
+// openCached opens name for reading by calling open, serving regular files
+// from the content cache. Files opened from the cache hold their contents
+// in memory. The caller must hold the filesystem lock.
+func (c *core) openCached(name string, open func() (absfs.File, error)) (absfs.File, error) {
+	key := c.abs(name)
+	if !c.direct(key, true) {
+		return open()
+	}
+	gen, epoch := c.gens.get(key), c.content.current()
+	if file := c.content.get(key, gen); file != nil {
+		return &snapshotFile{name: name, entry: file, r: bytes.NewReader(file.data)}, nil
+	}
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() > c.content.max {
+		return f, nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		if _, serr := f.Seek(0, io.SeekStart); serr == nil {
+			return f, nil
+		}
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+	file := &savedEntry{info: snapshotInfo(info), data: data}
+	c.content.put(key, gen, epoch, file)
+	return &snapshotFile{name: name, entry: file, r: bytes.NewReader(data)}, nil
+}
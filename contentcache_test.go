@@ -0,0 +1,165 @@
+package lockfs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func (c *countingFS) ReadFile(name string) ([]byte, error) {
+	c.calls.Add(1)
+	return c.SymlinkFileSystem.ReadFile(name)
+}
+
+// newContentFS returns a wrapper with a content cache of max bytes around a
+// counting memfs.
+func newContentFS(t *testing.T, max int64) (*SymlinkFileSystem, *countingFS) {
+	t.Helper()
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingFS{SymlinkFileSystem: mfs}
+	fsys, err := NewSymlinkFS(counting, WithContentCache(max))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, counting
+}
+
+// TestContentCache tests that file contents are served from the cache until
+// the file is mutated through the wrapper.
+func TestContentCache(t *testing.T) {
+	fsys, counting := newContentFS(t, 1<<20)
+	if err := fsys.WriteFileAtomic("/config.json", []byte(`{"v":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	read := func(want string) {
+		t.Helper()
+		data, err := fsys.ReadFile("/config.json")
+		if err != nil || string(data) != want {
+			t.Fatalf("ReadFile = %q, %v, want %q", data, err, want)
+		}
+		f, err := fsys.Open("/config.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err = io.ReadAll(f)
+		if err != nil || string(data) != want {
+			t.Fatalf("read from Open = %q, %v, want %q", data, err, want)
+		}
+	}
+	read(`{"v":1}`)
+	before := counting.calls.Load()
+	for i := 0; i < 10; i++ {
+		read(`{"v":1}`)
+	}
+	if calls := counting.calls.Load() - before; calls != 0 {
+		t.Errorf("cached reads reached the wrapped filesystem %d times", calls)
+	}
+
+	f, err := fsys.OpenFile("/config.json", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"v":2}`))
+	f.Close()
+	read(`{"v":2}`)
+
+	if err := fsys.WriteFileAtomic("/config.json", []byte(`{"v":3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	read(`{"v":3}`)
+}
+
+// TestContentCacheEviction tests that the cache evicts the least recently
+// used files to stay within its size limit.
+func TestContentCacheEviction(t *testing.T) {
+	fsys, counting := newContentFS(t, 10)
+	for _, name := range []string{"/a", "/b", "/c", "/big"} {
+		data := []byte("12345")
+		if name == "/big" {
+			data = []byte("12345678901")
+		}
+		if err := fsys.WriteFileAtomic(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hits := func(name string) bool {
+		t.Helper()
+		before := counting.calls.Load()
+		if _, err := fsys.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+		return counting.calls.Load() == before
+	}
+	hits("/a")
+	hits("/b")
+	if !hits("/a") {
+		t.Error("/a was not cached")
+	}
+	hits("/c")
+	if hits("/b") {
+		t.Error("/b was not evicted")
+	}
+	if !hits("/c") {
+		t.Error("/c was not cached")
+	}
+	hits("/big")
+	if hits("/big") {
+		t.Error("file larger than the cache was cached")
+	}
+	if fsys.content.size > fsys.content.max {
+		t.Errorf("cache holds %d bytes, limit is %d", fsys.content.size, fsys.content.max)
+	}
+}
+
+// followFS opens the targets of symbolic links, as OS filesystems do.
+type followFS struct {
+	absfs.SymlinkFileSystem
+}
+
+func (f *followFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if info, err := f.Lstat(name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if target, err := f.Readlink(name); err == nil {
+			name = target
+		}
+	}
+	return f.SymlinkFileSystem.OpenFile(name, flag, perm)
+}
+
+// TestContentCacheSymlinkWrite tests that writes through a symbolic link
+// make the cached contents of its target stale.
+func TestContentCacheSymlinkWrite(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewSymlinkFS(&followFS{mfs}, WithContentCache(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileAtomic("/target", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Symlink("/target", "/link"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := fsys.ReadFile("/target"); string(data) != "old" {
+		t.Fatalf("ReadFile = %q, want %q", data, "old")
+	}
+
+	f, err := fsys.OpenFile("/link", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if data, err := fsys.ReadFile("/target"); err != nil || string(data) != "new" {
+		t.Errorf("ReadFile after write through link = %q, %v, want %q", data, err, "new")
+	}
+}
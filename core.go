@@ -0,0 +1,222 @@
+package lockfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// access describes how an operation uses the filesystem. It selects the
+// filesystem lock mode and the advisory locks the operation must wait for.
+type access uint8
+
+const (
+	// shared operations take the filesystem read lock and only read the
+	// paths they name.
+	shared access = 0
+
+	// exclusive operations take the filesystem write lock.
+	exclusive access = 1 << iota
+
+	// mutating operations modify the paths they name, or the trees beneath
+	// them.
+	mutating
+
+	// flushing operations write data to storage without modifying it.
+	flushing
+)
+
+// openAccess returns the access an OpenFile call with flag requires.
+func openAccess(flag int) access {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return exclusive | mutating
+	}
+	return exclusive
+}
+
+// core holds the state shared by a wrapper, the views returned from its
+// WithContext method and the files opened through either of them.
+type core struct {
+	m    sync.RWMutex
+	base absfs.Filer
+
+	advisory  advisory
+	handles   handles
+	gens      generations
+	watchers  watchers
+	auditLog  *auditLog
+	meta      *metaCache
+	content   *contentCache
+	snapshots snapshots
+	versions  versions
+	wal       string // path of the write-ahead log, if any
+
+	shareModes     bool
+	defaultShare   ShareMode
+	busyMode       BusyMode
+	drainFiles     bool
+	freezeFailFast bool
+	mvcc           bool
+	groupSync      bool
+	syncWindow     time.Duration
+
+	closed   bool
+	readOnly bool
+	thaw     chan struct{} // non-nil while frozen, closed by Thaw
+	exports  int           // exports in progress
+	exported chan struct{} // non-nil while exporting, closed by the last export
+}
+
+func newCore(base absfs.Filer, opts []Option) (*core, error) {
+	c := &core{base: base}
+	c.gens.log.size = defaultJournalSize
+	c.versions.max = defaultMVCCSize
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.recoverWAL(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// wrapper is implemented by the wrappers in this package, and the views
+// returned from their WithContext methods. lockCore returns the state of the
+// wrapper and the context it performs operations with.
+type wrapper interface {
+	lockCore() (*core, context.Context)
+}
+
+func (f *Filer) lockCore() (*core, context.Context)             { return f.core, f.ctx }
+func (f *FileSystem) lockCore() (*core, context.Context)        { return f.core, f.ctx }
+func (f *SymlinkFileSystem) lockCore() (*core, context.Context) { return f.core, f.ctx }
+
+// locker implementation for hierarchical locking
+func (c *core) rlock()   { c.m.RLock() }
+func (c *core) runlock() { c.m.RUnlock() }
+func (c *core) lock()    { c.m.Lock() }
+func (c *core) unlock()  { c.m.Unlock() }
+
+// acquire takes the filesystem lock required by operation op of access a,
+// once no advisory lock held by an owner other than the one carried by ctx
+// conflicts with names. While waiting for such a lock the filesystem lock is
+// not held. An error is returned if ctx is done first, the wrapper is closed
+// or op would modify a read-only wrapper.
+func (c *core) acquire(ctx context.Context, op string, a access, names ...string) error {
+	return c.await(ctx, a, func() (<-chan struct{}, error) {
+		if err := c.ensureOpen(); err != nil {
+			return nil, err
+		}
+		if err := c.writable(op, a, names...); err != nil {
+			return nil, err
+		}
+		keys := c.keys(names)
+		wait := c.admit(ctx, a, keys)
+		if wait == nil && a&mutating != 0 {
+			c.preserve(keys, false)
+		}
+		return wait, nil
+	})
+}
+
+// await takes the filesystem lock required by a and calls ready, once the
+// operation is not held back by Freeze. If ready returns a channel, await
+// releases the lock, waits until the channel is closed and tries again. If
+// ready returns an error, await releases the lock and returns it.
+func (c *core) await(ctx context.Context, a access, ready func() (<-chan struct{}, error)) error {
+	for {
+		if a&exclusive != 0 {
+			c.m.Lock()
+		} else {
+			c.m.RLock()
+		}
+		wait, err := c.frozen(a)
+		if wait == nil && err == nil {
+			wait, err = ready()
+		}
+		if err != nil {
+			c.release(a)
+			return err
+		}
+		if wait == nil {
+			return nil
+		}
+		c.release(a)
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// admit returns a channel to wait on if an advisory lock held by an owner
+// other than the one carried by ctx conflicts with an operation of access a
+// on keys, and nil otherwise.
+func (c *core) admit(ctx context.Context, a access, keys []string) <-chan struct{} {
+	if !c.advisory.active() {
+		return nil
+	}
+	return c.advisory.blocked(OwnerFromContext(ctx), a&mutating != 0, keys)
+}
+
+// release releases the filesystem lock taken by acquire.
+func (c *core) release(a access) {
+	if a&exclusive != 0 {
+		c.m.Unlock()
+	} else {
+		c.m.RUnlock()
+	}
+}
+
+// mutated records that operation op mutated names, or the trees beneath them
+// if tree is set, unless err is not nil. It returns err. Cached metadata is
+// dropped either way, as failed operations may have made partial changes.
+// The caller must hold the filesystem lock.
+func (c *core) mutated(err error, op string, tree bool, names ...string) error {
+	keys := c.keys(names)
+	c.invalidate(keys, tree)
+	if err != nil {
+		return err
+	}
+	ch := c.gens.bump(op, keys, tree)
+	c.watchers.notify(ch)
+	return nil
+}
+
+// keys returns the keys of names. The caller must hold the filesystem lock.
+func (c *core) keys(names []string) []string {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = c.abs(name)
+	}
+	return keys
+}
+
+// abs returns the clean, absolute form of name that keys per-path state.
+// Relative names are resolved against the working directory of the wrapped
+// filesystem, so the caller must hold the filesystem lock.
+func (c *core) abs(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	if wd, ok := c.base.(interface{ Getwd() (string, error) }); ok {
+		if dir, err := wd.Getwd(); err == nil {
+			return path.Join(dir, name)
+		}
+	}
+	return path.Join("/", name)
+}
+
+// within reports whether name is dir or lies beneath it. Both must be clean
+// and absolute.
+func within(name, dir string) bool {
+	if dir == "/" || name == dir {
+		return true
+	}
+	return len(name) > len(dir) && name[len(dir)] == '/' && name[:len(dir)] == dir
+}
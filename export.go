@@ -0,0 +1,187 @@
+package lockfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// ExportTar writes the tree rooted at root in fsys to w as a tar archive,
+// with names relative to root. Modes, modification times and, if fsys
+// implements absfs.SymLinker, symbolic links are preserved.
+//
+// If fsys is a wrapper from this package, the export waits for the
+// mutations in progress to complete and holds back further ones, including
+// writes to open files, until it is done, as Freeze does, so the archive is
+// a point-in-time copy of the tree that no mutation through the wrapper can
+// tear. Reads proceed. Writes through the wrapper would wait for the export
+// to finish, so w must not write to fsys; ExportTar fails with os.ErrInvalid
+// if w is a file of the wrapper. Other filesystems are exported without any
+// locking.
+func ExportTar(fsys absfs.Filer, root string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := export(fsys, root, w, func(name string, info os.FileInfo, link string, content io.Reader) error {
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if content != nil {
+			_, err = io.Copy(tw, content)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ExportZip is like ExportTar, but writes a zip archive. Symbolic links are
+// stored as entries holding their target, with the mode of a link.
+func ExportZip(fsys absfs.Filer, root string, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := export(fsys, root, w, func(name string, info os.FileInfo, link string, content io.Reader) error {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		entry, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			_, err = io.WriteString(entry, link)
+		case content != nil:
+			_, err = io.Copy(entry, content)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// export walks the tree rooted at root in fsys, holding back the mutations
+// of fsys if it is a wrapper, and calls add for every entry beneath root in
+// lexical order. link is the target of symbolic links, and content reads
+// regular files. The filesystem read lock is only held while fsys is read,
+// not while add writes the entries to w, which must not be a file of fsys.
+func export(fsys absfs.Filer, root string, w io.Writer, add func(name string, info os.FileInfo, link string, content io.Reader) error) error {
+	locked := func(read func() error) error { return read() }
+	if wr, ok := fsys.(wrapper); ok {
+		c, _ := wr.lockCore()
+		if f, ok := w.(*File); ok && f.parent == c {
+			return &os.PathError{Op: "export", Path: root, Err: os.ErrInvalid}
+		}
+		done, err := c.hold()
+		if err != nil {
+			return err
+		}
+		defer done()
+		locked = func(read func() error) error {
+			c.m.RLock()
+			defer c.m.RUnlock()
+			if err := c.ensureOpen(); err != nil {
+				return err
+			}
+			return read()
+		}
+		fsys = c.base
+	}
+	lstat := fsys.Stat
+	sl, symlinks := fsys.(absfs.SymLinker)
+	if symlinks {
+		lstat = sl.Lstat
+	}
+
+	var walk func(dir, rel string) error
+	walk = func(dir, rel string) error {
+		var entries []fs.DirEntry
+		err := locked(func() (err error) {
+			entries, err = fsys.ReadDir(dir)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		for _, e := range entries {
+			name, p := path.Join(rel, e.Name()), path.Join(dir, e.Name())
+			var info os.FileInfo
+			var link string
+			err := locked(func() (err error) {
+				if info, err = lstat(p); err == nil && info.Mode()&os.ModeSymlink != 0 && symlinks {
+					link, err = sl.Readlink(p)
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			switch mode := info.Mode(); {
+			case mode&os.ModeSymlink != 0 && symlinks:
+				err = add(name, info, link, nil)
+			case mode.IsRegular():
+				var f absfs.File
+				if err := locked(func() (err error) {
+					f, err = fsys.OpenFile(p, os.O_RDONLY, 0)
+					return err
+				}); err != nil {
+					return err
+				}
+				err = add(name, info, "", &lockedReader{f, locked})
+				locked(f.Close)
+			default:
+				err = add(name, info, "", nil)
+			}
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if err := walk(p, name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(root, "")
+}
+
+// lockedReader reads from r with the filesystem read lock held by locked.
+type lockedReader struct {
+	r      io.Reader
+	locked func(func() error) error
+}
+
+func (r *lockedReader) Read(p []byte) (n int, err error) {
+	lerr := r.locked(func() error {
+		n, err = r.r.Read(p)
+		return nil
+	})
+	if lerr != nil {
+		return 0, lerr
+	}
+	return n, err
+}
@@ -0,0 +1,245 @@
+package lockfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+)
+
+func newExportFS(t *testing.T, opts ...Option) *SymlinkFileSystem {
+	t.Helper()
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewSymlinkFS(mfs, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.MkdirAll("/data/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Create("/data/sub/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	if err := fsys.Chmod("/data/sub/file.txt", 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fsys.Chtimes("/data/sub/file.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Symlink("sub/file.txt", "/data/link"); err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+// TestExportTar tests that ExportTar archives files, directories and symbolic
+// links with their metadata.
+func TestExportTar(t *testing.T) {
+	fsys := newExportFS(t)
+
+	var buf bytes.Buffer
+	if err := ExportTar(fsys, "/data", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = string(data)
+	}
+
+	if len(headers) != 3 {
+		t.Fatalf("expected 3 entries, got %v", headers)
+	}
+	if hdr := headers["sub/"]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+		t.Errorf("expected directory sub/, got %+v", hdr)
+	}
+	hdr := headers["sub/file.txt"]
+	if hdr == nil || hdr.Typeflag != tar.TypeReg {
+		t.Fatalf("expected regular file sub/file.txt, got %+v", hdr)
+	}
+	if contents["sub/file.txt"] != "hello" {
+		t.Errorf("expected content %q, got %q", "hello", contents["sub/file.txt"])
+	}
+	if hdr.Mode&0777 != 0640 {
+		t.Errorf("expected mode 0640, got %o", hdr.Mode)
+	}
+	if !hdr.ModTime.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("unexpected modification time %v", hdr.ModTime)
+	}
+	if hdr := headers["link"]; hdr == nil || hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "sub/file.txt" {
+		t.Errorf("expected symlink to sub/file.txt, got %+v", hdr)
+	}
+}
+
+// TestExportZip tests that ExportZip archives files, directories and
+// symbolic links.
+func TestExportZip(t *testing.T) {
+	fsys := newExportFS(t)
+
+	var buf bytes.Buffer
+	if err := ExportZip(fsys, "/data", &buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"link": "sub/file.txt", "sub/": "", "sub/file.txt": "hello"}
+	if len(zr.File) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(zr.File))
+	}
+	for _, zf := range zr.File {
+		content, ok := want[zf.Name]
+		if !ok {
+			t.Errorf("unexpected entry %s", zf.Name)
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if string(data) != content {
+			t.Errorf("%s: expected %q, got %q", zf.Name, content, data)
+		}
+		if zf.Name == "link" && zf.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expected link to be a symlink, got mode %v", zf.Mode())
+		}
+	}
+}
+
+// TestExportClosed tests that exporting a closed wrapper fails.
+func TestExportClosed(t *testing.T) {
+	fsys := newExportFS(t)
+	if err := fsys.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExportTar(fsys, "/data", io.Discard); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+// blockingWriter signals started on its first write and waits for release.
+type blockingWriter struct {
+	buf              bytes.Buffer
+	started, release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if w.started != nil {
+		close(w.started)
+		w.started = nil
+		<-w.release
+	}
+	return w.buf.Write(p)
+}
+
+// TestExportHoldsWrites tests that writes to open files wait for an export
+// in progress, so it archives the content from before them, while reads
+// proceed.
+func TestExportHoldsWrites(t *testing.T) {
+	fsys := newExportFS(t)
+	f, err := fsys.OpenFile("/data/sub/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	started := w.started
+	exported := make(chan error, 1)
+	go func() { exported <- ExportTar(fsys, "/data", w) }()
+	<-started
+
+	wrote, made := make(chan error, 1), make(chan error, 1)
+	go func() {
+		_, err := f.WriteAt([]byte("HELLO"), 0)
+		wrote <- err
+	}()
+	go func() { made <- fsys.Mkdir("/data/new", 0755) }()
+	select {
+	case err := <-wrote:
+		t.Fatalf("write completed during the export: %v", err)
+	case err := <-made:
+		t.Fatalf("Mkdir completed during the export: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if data, err := fsys.ReadFile("/data/sub/file.txt"); err != nil || string(data) != "hello" {
+		t.Fatalf("expected reads to proceed, got %q, %v", data, err)
+	}
+	if _, err := fsys.Stat("/data/sub"); err != nil {
+		t.Fatalf("expected Stat to proceed, got %v", err)
+	}
+
+	close(w.release)
+	if err := <-exported; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-wrote; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-made; err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&w.buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "sub/file.txt" {
+			data, _ := io.ReadAll(tr)
+			if string(data) != "hello" {
+				t.Errorf("expected the content from before the write, got %q", data)
+			}
+			break
+		}
+	}
+}
+
+// TestExportToWrapperFile tests that exporting into a file of the exported
+// wrapper fails rather than waits for itself.
+func TestExportToWrapperFile(t *testing.T) {
+	fsys := newExportFS(t)
+	f, err := fsys.Create("/archive.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := ExportTar(fsys, "/data", f); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected os.ErrInvalid, got %v", err)
+	}
+	if err := fsys.Mkdir("/data/new", 0755); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,116 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrFrozen is returned by Freeze on a frozen wrapper, and by operations that
+// would modify a frozen wrapper created with WithFreezeFailFast.
+var ErrFrozen = errors.New("filesystem frozen")
+
+// ErrNotFrozen is returned by Thaw on a wrapper that is not frozen.
+var ErrNotFrozen = errors.New("filesystem not frozen")
+
+// Freeze quiesces the wrapper, in the manner of fsfreeze on Linux, so a
+// consistent backup can be taken through it. Freeze waits for the mutations
+// and file writes in progress to complete, or for ctx to be done. Once it
+// returns, all operations that modify the filesystem, including opening
+// files for writing and Write, WriteAt, WriteString, Truncate and Sync on
+// open files, wait until Thaw is called, or fail with ErrFrozen if the
+// wrapper was created with WithFreezeFailFast. Reads proceed as usual.
+func (c *core) Freeze(ctx context.Context) error {
+	if err := c.lockContext(ctx); err != nil {
+		return err
+	}
+	defer c.m.Unlock()
+	if err := c.ensureOpen(); err != nil {
+		return err
+	}
+	if c.thaw != nil {
+		return ErrFrozen
+	}
+	c.thaw = make(chan struct{})
+	return nil
+}
+
+// Thaw resumes the operations held back by Freeze.
+func (c *core) Thaw() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.thaw == nil {
+		return ErrNotFrozen
+	}
+	c.unfreeze()
+	return nil
+}
+
+// unfreeze wakes the operations waiting for the wrapper to thaw. The caller
+// must hold the filesystem write lock.
+func (c *core) unfreeze() {
+	if c.thaw != nil {
+		close(c.thaw)
+		c.thaw = nil
+	}
+}
+
+// frozen returns a channel to wait on if an operation of access a is held
+// back by Freeze or an export, and nil otherwise. The caller must hold the
+// filesystem lock.
+func (c *core) frozen(a access) (<-chan struct{}, error) {
+	if a&(mutating|flushing) == 0 {
+		return nil, nil
+	}
+	if c.thaw != nil {
+		if c.freezeFailFast {
+			return nil, ErrFrozen
+		}
+		return c.thaw, nil
+	}
+	return c.exported, nil
+}
+
+// hold holds back the operations Freeze does until the returned function is
+// called, once the ones in progress have completed. Unlike Freeze, it never
+// makes them fail, and any number of holds can be taken at once.
+func (c *core) hold() (func(), error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := c.ensureOpen(); err != nil {
+		return nil, err
+	}
+	if c.exports == 0 {
+		c.exported = make(chan struct{})
+	}
+	c.exports++
+	return func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.exports--; c.exports == 0 {
+			close(c.exported)
+			c.exported = nil
+		}
+	}, nil
+}
+
+// lockContext takes the filesystem write lock, unless ctx is done first.
+func (c *core) lockContext(ctx context.Context) error {
+	if c.m.TryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		c.m.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			c.m.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
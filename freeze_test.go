@@ -0,0 +1,122 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestFreezeBlocksMutations tests that mutations wait while the wrapper is
+// frozen, while reads proceed.
+func TestFreezeBlocksMutations(t *testing.T) {
+	fsys := newShareFS(t)
+
+	f, err := fsys.OpenFile("/dir/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsys.Freeze(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Freeze(context.Background()); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("expected ErrFrozen, got %v", err)
+	}
+
+	if _, err := fsys.Stat("/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := fsys.WithContext(ctx).Mkdir("/blocked", 0755); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Mkdir to wait, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.Write([]byte("data"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Write returned while frozen: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := fsys.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write did not proceed after Thaw")
+	}
+	if err := fsys.Thaw(); !errors.Is(err, ErrNotFrozen) {
+		t.Fatalf("expected ErrNotFrozen, got %v", err)
+	}
+}
+
+// TestFreezeFailFast tests that mutations fail with ErrFrozen while frozen
+// with WithFreezeFailFast.
+func TestFreezeFailFast(t *testing.T) {
+	fsys := newShareFS(t, WithFreezeFailFast())
+
+	f, err := fsys.OpenFile("/dir/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsys.Freeze(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.Thaw()
+
+	if err := fsys.Remove("/dir/file.txt"); !errors.Is(err, ErrFrozen) {
+		t.Errorf("Remove: expected ErrFrozen, got %v", err)
+	}
+	if _, err := fsys.Create("/new.txt"); !errors.Is(err, ErrFrozen) {
+		t.Errorf("Create: expected ErrFrozen, got %v", err)
+	}
+	if _, err := f.Write([]byte("data")); !errors.Is(err, ErrFrozen) {
+		t.Errorf("Write: expected ErrFrozen, got %v", err)
+	}
+	if err := f.Sync(); !errors.Is(err, ErrFrozen) {
+		t.Errorf("Sync: expected ErrFrozen, got %v", err)
+	}
+	if _, err := fsys.Open("/dir/file.txt"); err != nil {
+		t.Errorf("Open: %v", err)
+	}
+}
+
+// TestFreezeWaitsForWriters tests that Freeze waits for file operations in
+// progress, until its context is done.
+func TestFreezeWaitsForWriters(t *testing.T) {
+	fsys := newShareFS(t)
+
+	// Hold the filesystem read lock as a file operation in progress would.
+	fsys.rlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := fsys.Freeze(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Freeze to wait, got %v", err)
+	}
+	fsys.runlock()
+
+	if err := fsys.Freeze(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,159 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ErrConflict is returned by WriteFileIfGen if the file was mutated after
+// the expected generation.
+var ErrConflict = errors.New("generation conflict")
+
+// generations tracks the generation of paths, which increases whenever the
+// path, or a tree containing it, is mutated through the wrapper. Paths that
+// have not been mutated are at generation 0.
+type generations struct {
+	mu   sync.Mutex
+	seq  uint64
+	path map[string]uint64 // generation of individual paths
+	tree map[string]uint64 // generation of the trees beneath paths
+	log  journal
+
+	waiting map[string]chan struct{} // closed when the keyed path changes
+}
+
+// bump advances the generation of keys, or of the trees beneath them if
+// tree is set, to a new generation, and records the change made by op in the
+// journal. keys holds the old and the new path of renames.
+func (g *generations) bump(op string, keys []string, tree bool) Change {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.path == nil {
+		g.path = make(map[string]uint64)
+		g.tree = make(map[string]uint64)
+	}
+	g.seq++
+	for _, key := range keys {
+		if tree {
+			g.tree[key] = g.seq
+		}
+		g.path[key] = g.seq
+	}
+	ch := Change{Op: op, Path: keys[len(keys)-1], Tree: tree, Gen: g.seq, Time: time.Now()}
+	if len(keys) == 2 {
+		ch.OldPath = keys[0]
+	}
+	g.log.add(ch)
+	g.wake(keys, tree)
+	return ch
+}
+
+// current returns the most recent generation.
+func (g *generations) current() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.seq
+}
+
+// since returns the changes recorded after generation gen.
+func (g *generations) since(gen uint64) ([]Change, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.log.since(gen)
+}
+
+// get returns the generation of key.
+func (g *generations) get(key string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.seq == 0 {
+		return 0
+	}
+	gen := g.path[key]
+	for dir := key; ; dir = path.Dir(dir) {
+		if t := g.tree[dir]; t > gen {
+			gen = t
+		}
+		if dir == "/" {
+			return gen
+		}
+	}
+}
+
+// ReadFileVersion reads the named file and returns its contents along with
+// its generation, for use with WriteFileIfGen.
+func (f *Filer) ReadFileVersion(name string) ([]byte, uint64, error) {
+	return f.readFileVersion(f.ctx, name)
+}
+
+// WriteFileIfGen replaces the contents of the named file with data, like
+// WriteFileAtomic, if its generation is still gen. Otherwise it returns
+// ErrConflict, wrapped in an *os.PathError. A gen of 0 matches files that
+// have not been mutated through the wrapper, including ones that do not
+// exist yet; new files are created with mode 0666 before umask.
+func (f *Filer) WriteFileIfGen(name string, data []byte, gen uint64) error {
+	return f.writeFileIfGen(f.ctx, name, data, gen)
+}
+
+// ReadFileVersion reads the named file and returns its contents along with
+// its generation, for use with WriteFileIfGen.
+func (f *FileSystem) ReadFileVersion(name string) ([]byte, uint64, error) {
+	return f.readFileVersion(f.ctx, name)
+}
+
+// WriteFileIfGen replaces the contents of the named file with data, like
+// WriteFileAtomic, if its generation is still gen. Otherwise it returns
+// ErrConflict, wrapped in an *os.PathError. A gen of 0 matches files that
+// have not been mutated through the wrapper, including ones that do not
+// exist yet; new files are created with mode 0666 before umask.
+func (f *FileSystem) WriteFileIfGen(name string, data []byte, gen uint64) error {
+	return f.writeFileIfGen(f.ctx, name, data, gen)
+}
+
+// ReadFileVersion reads the named file and returns its contents along with
+// its generation, for use with WriteFileIfGen.
+func (f *SymlinkFileSystem) ReadFileVersion(name string) ([]byte, uint64, error) {
+	return f.readFileVersion(f.ctx, name)
+}
+
+// WriteFileIfGen replaces the contents of the named file with data, like
+// WriteFileAtomic, if its generation is still gen. Otherwise it returns
+// ErrConflict, wrapped in an *os.PathError. A gen of 0 matches files that
+// have not been mutated through the wrapper, including ones that do not
+// exist yet; new files are created with mode 0666 before umask.
+func (f *SymlinkFileSystem) WriteFileIfGen(name string, data []byte, gen uint64) error {
+	return f.writeFileIfGen(f.ctx, name, data, gen)
+}
+
+func (c *core) readFileVersion(ctx context.Context, name string) ([]byte, uint64, error) {
+	if err := c.acquire(ctx, "readfile", shared, name); err != nil {
+		return nil, 0, err
+	}
+	defer c.release(shared)
+	// Files may be written while the read lock is held, so the generation
+	// is taken first: a write racing with the read then makes
+	// WriteFileIfGen fail rather than overwrite it.
+	gen := c.gens.get(c.abs(name))
+	data, err := c.base.ReadFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, gen, nil
+}
+
+func (c *core) writeFileIfGen(ctx context.Context, name string, data []byte, gen uint64) (err error) {
+	defer c.audit(ctx, &err, AuditRecord{Op: "writefileifgen", Path: name, Size: int64ptr(len(data)), Gen: &gen})
+	return c.replaceFile(ctx, name, data, 0666, func(key string) error {
+		if c.gens.get(key) != gen {
+			return &os.PathError{Op: "writefile", Path: name, Err: ErrConflict}
+		}
+		if c.shareModes && c.handles.denies(key, false, DenyWrite|DenyDelete) {
+			return &os.PathError{Op: "writefile", Path: name, Err: ErrSharingViolation}
+		}
+		return nil
+	})
+}
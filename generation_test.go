@@ -0,0 +1,100 @@
+package lockfs
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestWriteFileIfGen tests that WriteFileIfGen succeeds at the current
+// generation and fails with ErrConflict after a mutation.
+func TestWriteFileIfGen(t *testing.T) {
+	fsys := newShareFS(t)
+
+	data, gen, err := fsys.ReadFileVersion("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileIfGen("/dir/file.txt", append(data, 'a'), gen); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileIfGen("/dir/file.txt", append(data, 'b'), gen); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	data, gen, err = fsys.ReadFileVersion("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a" {
+		t.Fatalf("expected %q, got %q", "a", data)
+	}
+
+	// Writes through open files and mutations of containing trees advance
+	// the generation too.
+	f, err := fsys.OpenFile("/dir/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("x"))
+	f.Close()
+	if err := fsys.WriteFileIfGen("/dir/file.txt", nil, gen); !errors.Is(err, ErrConflict) {
+		t.Errorf("after Write: expected ErrConflict, got %v", err)
+	}
+	_, gen, _ = fsys.ReadFileVersion("/dir/file.txt")
+	if err := fsys.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/moved", "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileIfGen("/dir/file.txt", nil, gen); !errors.Is(err, ErrConflict) {
+		t.Errorf("after Rename: expected ErrConflict, got %v", err)
+	}
+
+	// Files that were never mutated are at generation 0.
+	if err := fsys.WriteFileIfGen("/new.txt", []byte("new"), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWriteFileIfGenConcurrent tests that concurrent read-modify-write cycles
+// retrying on ErrConflict lose no updates.
+func TestWriteFileIfGenConcurrent(t *testing.T) {
+	fsys := newShareFS(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				for {
+					data, gen, err := fsys.ReadFileVersion("/dir/file.txt")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					err = fsys.WriteFileIfGen("/dir/file.txt", append(data, 'x'), gen)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrConflict) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := fsys.ReadFile("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 100 {
+		t.Errorf("expected 100 updates, got %d", len(data))
+	}
+}
@@ -0,0 +1,82 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// syncGroup coalesces the concurrent Sync calls on a file in group-commit
+// mode.
+type syncGroup struct {
+	mu    sync.Mutex
+	batch *syncBatch // batch collecting Sync calls, if any
+}
+
+// syncBatch is a set of Sync calls served by one underlying Sync.
+type syncBatch struct {
+	done  chan struct{} // closed once err or retry is set
+	err   error
+	retry bool // the call syncing the batch gave up, as its context is done
+}
+
+// groupSync syncs the file as part of a batch of concurrent Sync calls. The
+// first call of a batch waits for the group-commit window to collect others,
+// then syncs the file on behalf of all of them. Calls made while it syncs
+// join the next batch, so each call is covered by a Sync that started after
+// it was made. Calls stop waiting once ctx is done; if the call syncing a
+// batch does, the others join the next batch.
+func (f *File) groupSync(ctx context.Context) error {
+	for {
+		if f.closed.Load() {
+			return os.ErrClosed
+		}
+		f.syncs.mu.Lock()
+		b := f.syncs.batch
+		lead := b == nil
+		if lead {
+			b = &syncBatch{done: make(chan struct{})}
+			f.syncs.batch = b
+		}
+		f.syncs.mu.Unlock()
+		if lead {
+			return f.syncBatch(ctx, b)
+		}
+		select {
+		case <-b.done:
+			if !b.retry {
+				return b.err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// syncBatch syncs the file on behalf of batch b, after the group-commit
+// window.
+func (f *File) syncBatch(ctx context.Context, b *syncBatch) error {
+	timer := time.NewTimer(f.parent.syncWindow)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	f.syncs.mu.Lock()
+	f.syncs.batch = nil
+	f.syncs.mu.Unlock()
+	if err == nil {
+		err = f.sync(ctx)
+	}
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		b.retry = true
+	} else {
+		b.err = err
+	}
+	close(b.done)
+	return err
+}
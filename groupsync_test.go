@@ -0,0 +1,86 @@
+package lockfs
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// syncCountingFS counts the Sync calls made to the files it creates.
+type syncCountingFS struct {
+	absfs.FileSystem
+	syncs atomic.Int32
+}
+
+func (s *syncCountingFS) Create(name string) (absfs.File, error) {
+	f, err := s.FileSystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{File: f, fs: s}, nil
+}
+
+type syncCountingFile struct {
+	absfs.File
+	fs *syncCountingFS
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.fs.syncs.Add(1)
+	return f.File.Sync()
+}
+
+// TestGroupSync tests that concurrent Sync calls share an underlying Sync.
+func TestGroupSync(t *testing.T) {
+	for _, group := range []bool{false, true} {
+		mfs, err := memfs.NewFS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting := &syncCountingFS{FileSystem: mfs}
+		var opts []Option
+		if group {
+			opts = append(opts, WithGroupSync(50*time.Millisecond))
+		}
+		fsys, err := NewFS(counting, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := fsys.Create("/wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := f.Write([]byte("record\n")); err != nil {
+					t.Error(err)
+				}
+				if err := f.Sync(); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		syncs := counting.syncs.Load()
+		switch {
+		case !group && syncs != 10:
+			t.Errorf("without group sync: %d underlying syncs, want 10", syncs)
+		case group && (syncs < 1 || syncs > 2):
+			t.Errorf("with group sync: %d underlying syncs, want 1 or 2", syncs)
+		}
+
+		f.Close()
+		if err := f.Sync(); err == nil {
+			t.Errorf("group sync %v: Sync after Close succeeded", group)
+		}
+	}
+}
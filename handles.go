@@ -0,0 +1,294 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrSharingViolation is returned when an open, remove or rename conflicts
+// with the share mode of a file that is already open.
+var ErrSharingViolation = errors.New("sharing violation")
+
+// BusyMode selects how Remove, RemoveAll, Rename and Truncate treat paths
+// that files are open at, or beneath.
+type BusyMode uint8
+
+const (
+	// BusyIgnore leaves it to the wrapped filesystem, which may remove files
+	// that are still open.
+	BusyIgnore BusyMode = iota
+
+	// BusyFail makes the operation fail with syscall.EBUSY.
+	BusyFail
+
+	// BusyWait makes the operation wait until the files are closed. A
+	// goroutine waiting for files it holds open itself waits forever, unless
+	// it operates through a WithContext view whose context is done.
+	BusyWait
+)
+
+// ShareMode restricts the access other files may be opened with while a file
+// is open, in the manner of the share modes of Windows. Share modes are only
+// enforced by wrappers created with WithShareModes.
+type ShareMode uint8
+
+const (
+	// DenyRead denies opening the file for reading.
+	DenyRead ShareMode = 1 << iota
+
+	// DenyWrite denies opening the file for writing.
+	DenyWrite
+
+	// DenyDelete denies removing the file or renaming it, or a directory
+	// containing it.
+	DenyDelete
+)
+
+// reads reports whether a file opened with flag may be read from.
+func reads(flag int) bool {
+	return flag&absfs.O_ACCESS != os.O_WRONLY
+}
+
+// writes reports whether a file opened with flag may be written to.
+func writes(flag int) bool {
+	return flag&absfs.O_ACCESS != os.O_RDONLY || flag&os.O_TRUNC != 0
+}
+
+// handles tracks the files open through a wrapper by the path they were
+// opened at.
+type handles struct {
+	mu     sync.Mutex
+	files  map[string]map[*File]struct{}
+	closed chan struct{} // closed whenever a file is closed
+}
+
+// all returns the files that are open.
+func (h *handles) all() []*File {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var files []*File
+	for _, set := range h.files {
+		for f := range set {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (h *handles) add(f *File) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.files == nil {
+		h.files = make(map[string]map[*File]struct{})
+	}
+	set := h.files[f.key]
+	if set == nil {
+		set = make(map[*File]struct{})
+		h.files[f.key] = set
+	}
+	set[f] = struct{}{}
+}
+
+func (h *handles) remove(f *File) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	set := h.files[f.key]
+	delete(set, f)
+	if len(set) == 0 {
+		delete(h.files, f.key)
+	}
+	if h.closed != nil {
+		close(h.closed)
+		h.closed = nil
+	}
+}
+
+// busy returns a channel that is closed when the next file is closed if a
+// file is open at key, or beneath it if tree is set, and nil otherwise.
+func (h *handles) busy(key string, tree bool) <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for open := range h.files {
+		if open == key || tree && within(open, key) {
+			if h.closed == nil {
+				h.closed = make(chan struct{})
+			}
+			return h.closed
+		}
+	}
+	return nil
+}
+
+// conflict reports whether opening key with flag and share conflicts with
+// the share mode or the access of a file open at key.
+func (h *handles) conflict(key string, flag int, share ShareMode) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for f := range h.files[key] {
+		if reads(flag) && f.share&DenyRead != 0 ||
+			writes(flag) && f.share&DenyWrite != 0 ||
+			share&DenyRead != 0 && reads(f.flag) ||
+			share&DenyWrite != 0 && writes(f.flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// denies reports whether a file open at key, or beneath it if tree is set,
+// has a share mode denying any of deny.
+func (h *handles) denies(key string, tree bool, deny ShareMode) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for open, set := range h.files {
+		if open != key && !(tree && within(open, key)) {
+			continue
+		}
+		for f := range set {
+			if f.share&deny != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// move rekeys the files open at oldKey, or beneath it, after it was renamed
+// to newKey. The caller must hold the filesystem write lock.
+func (h *handles) move(oldKey, newKey string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	moved := make(map[string]map[*File]struct{})
+	for open, set := range h.files {
+		if within(open, oldKey) {
+			moved[open] = set
+			delete(h.files, open)
+		}
+	}
+	for open, set := range moved {
+		key := newKey + open[len(oldKey):]
+		if oldKey == "/" {
+			key = path.Join(newKey, open)
+		}
+		dst := h.files[key]
+		if dst == nil {
+			dst = make(map[*File]struct{})
+			h.files[key] = dst
+		}
+		for f := range set {
+			f.key = key
+			dst[f] = struct{}{}
+		}
+	}
+}
+
+// openFile opens name on behalf of the Owner carried by ctx by calling open
+// with the filesystem lock required by a held, and wraps and tracks the
+// resulting file. flag and perm must describe the access open requests.
+func (c *core) openFile(ctx context.Context, a access, name string, flag int, perm os.FileMode, share ShareMode, open func() (absfs.File, error)) (_ absfs.File, err error) {
+	if a&mutating != 0 {
+		defer c.audit(ctx, &err, AuditRecord{Op: "open", Path: name, Flag: &flag, Mode: &perm})
+	}
+	if err := c.acquire(ctx, "open", a, name); err != nil {
+		return nil, err
+	}
+	defer c.release(a)
+
+	key := c.abs(name)
+	if c.shareModes && c.handles.conflict(key, flag, share) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrSharingViolation}
+	}
+	probe := c.meta != nil && c.meta.misses && flag&os.O_CREATE == 0 && c.direct(key, true)
+	var epoch uint64
+	if probe {
+		if err := c.meta.missed(key); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		epoch = c.meta.current()
+	}
+	if c.content != nil && a&mutating == 0 {
+		cached := open
+		open = func() (absfs.File, error) { return c.openCached(name, cached) }
+	}
+	existed := flag&os.O_CREATE == 0 || c.exists(name)
+	file, err := open()
+	if err != nil {
+		if probe {
+			c.meta.miss(key, epoch, err)
+		}
+		return nil, err
+	}
+	switch {
+	case !existed:
+		c.mutated(nil, "create", false, name)
+	case flag&os.O_TRUNC != 0:
+		c.mutated(nil, "truncate", false, name)
+	}
+	f := &File{f: file, parent: c, ctx: ctx, key: key, flag: flag, share: share}
+	c.handles.add(f)
+	return f, nil
+}
+
+// exists reports whether name exists in the wrapped filesystem. The caller
+// must hold the filesystem lock.
+func (c *core) exists(name string) bool {
+	_, err := c.base.Stat(name)
+	return err == nil
+}
+
+// acquireIdle is like acquire for an operation that mutates names, but also
+// applies the busy mode to files open at names, or beneath them if tree is
+// set. op names the operation in EBUSY errors.
+func (c *core) acquireIdle(ctx context.Context, op string, tree bool, names ...string) error {
+	a := exclusive | mutating
+	return c.await(ctx, a, func() (<-chan struct{}, error) {
+		if err := c.ensureOpen(); err != nil {
+			return nil, err
+		}
+		if err := c.writable(op, a, names...); err != nil {
+			return nil, err
+		}
+		keys := c.keys(names)
+		if wait := c.admit(ctx, a, keys); wait != nil {
+			return wait, nil
+		}
+		for _, key := range keys {
+			if c.busyMode == BusyIgnore {
+				break
+			}
+			wait := c.handles.busy(key, tree)
+			switch {
+			case wait == nil:
+				continue
+			case c.busyMode == BusyWait:
+				return wait, nil
+			case len(names) == 2:
+				return nil, &os.LinkError{Op: op, Old: names[0], New: names[1], Err: syscall.EBUSY}
+			default:
+				return nil, &os.PathError{Op: op, Path: names[0], Err: syscall.EBUSY}
+			}
+		}
+		c.preserve(keys, tree)
+		return nil, nil
+	})
+}
+
+// deleteDenied reports whether a file open at name, or beneath it if tree is
+// set, denies its deletion. The caller must hold the filesystem lock.
+func (c *core) deleteDenied(name string, tree bool) bool {
+	return c.shareModes && c.handles.denies(c.abs(name), tree, DenyDelete)
+}
+
+// renamed updates the files open beneath oldpath after it was renamed to
+// newpath, and records the mutation. The caller must hold the filesystem
+// write lock.
+func (c *core) renamed(oldpath, newpath string) {
+	c.handles.move(c.abs(oldpath), c.abs(newpath))
+	c.mutated(nil, "rename", true, oldpath, newpath)
+}
@@ -0,0 +1,251 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+)
+
+func newShareFS(t *testing.T, opts ...Option) *FileSystem {
+	t.Helper()
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(mfs, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Create("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return fsys
+}
+
+// TestShareModeOpenConflicts tests that opens conflicting with the share mode
+// or the access of open files fail.
+func TestShareModeOpenConflicts(t *testing.T) {
+	fsys := newShareFS(t, WithShareModes(0))
+
+	f, err := fsys.OpenFileShare("/dir/file.txt", os.O_RDONLY, 0, DenyWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading is still allowed, writing is not.
+	r, err := fsys.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fsys.OpenFile("/dir/file.txt", os.O_WRONLY, 0)
+	if !errors.Is(err, ErrSharingViolation) {
+		t.Fatalf("expected ErrSharingViolation, got %v", err)
+	}
+
+	// Denying read conflicts with the reader already open.
+	_, err = fsys.OpenFileShare("/dir/file.txt", os.O_RDONLY, 0, DenyRead)
+	if !errors.Is(err, ErrSharingViolation) {
+		t.Fatalf("expected ErrSharingViolation, got %v", err)
+	}
+
+	f.Close()
+	r.Close()
+
+	w, err := fsys.OpenFileShare("/dir/file.txt", os.O_WRONLY, 0, DenyRead|DenyWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Open("/dir/file.txt"); !errors.Is(err, ErrSharingViolation) {
+		t.Fatalf("expected ErrSharingViolation, got %v", err)
+	}
+	w.Close()
+	if _, err := fsys.Open("/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestShareModeDenyDelete tests that files opened with DenyDelete cannot be
+// removed or renamed.
+func TestShareModeDenyDelete(t *testing.T) {
+	fsys := newShareFS(t, WithShareModes(DenyDelete))
+
+	f, err := fsys.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fsys.Remove("/dir/file.txt"); !errors.Is(err, ErrSharingViolation) {
+		t.Fatalf("Remove: expected ErrSharingViolation, got %v", err)
+	}
+	if err := fsys.RemoveAll("/dir"); !errors.Is(err, ErrSharingViolation) {
+		t.Fatalf("RemoveAll: expected ErrSharingViolation, got %v", err)
+	}
+	err = fsys.Rename("/dir", "/moved")
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) || !errors.Is(err, ErrSharingViolation) {
+		t.Fatalf("Rename: expected *os.LinkError with ErrSharingViolation, got %v", err)
+	}
+
+	f.Close()
+	if err := fsys.Remove("/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestShareModeDenyWriteTruncate tests that files opened with DenyWrite
+// cannot be truncated by path.
+func TestShareModeDenyWriteTruncate(t *testing.T) {
+	fsys := newShareFS(t, WithShareModes(0))
+	if err := fsys.WriteFileAtomic("/dir/file.txt", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fsys.OpenFileShare("/dir/file.txt", os.O_RDONLY, 0, DenyWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.Truncate("/dir/file.txt", 0)
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || !errors.Is(err, ErrSharingViolation) {
+		t.Fatalf("Truncate: expected *os.PathError with ErrSharingViolation, got %v", err)
+	}
+	if info, err := fsys.Stat("/dir/file.txt"); err != nil || info.Size() != 7 {
+		t.Fatalf("file changed: %v, %v", info, err)
+	}
+
+	f.Close()
+	if err := fsys.Truncate("/dir/file.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestShareModeFollowsRename tests that open files are tracked at their new
+// path after a rename.
+func TestShareModeFollowsRename(t *testing.T) {
+	fsys := newShareFS(t, WithShareModes(0))
+
+	f, err := fsys.OpenFileShare("/dir/file.txt", os.O_RDONLY, 0, DenyWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsys.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.OpenFile("/moved/file.txt", os.O_RDWR, 0); !errors.Is(err, ErrSharingViolation) {
+		t.Fatalf("expected ErrSharingViolation at the new path, got %v", err)
+	}
+}
+
+// TestShareModeDisabled tests that share modes are ignored unless enabled.
+func TestShareModeDisabled(t *testing.T) {
+	fsys := newShareFS(t)
+
+	f, err := fsys.OpenFileShare("/dir/file.txt", os.O_RDONLY, 0, DenyRead|DenyWrite|DenyDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := fsys.OpenFile("/dir/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := fsys.Remove("/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBusyModeFail tests that removing, renaming and truncating paths with
+// open files fails with EBUSY in BusyFail mode.
+func TestBusyModeFail(t *testing.T) {
+	fsys := newShareFS(t, WithBusyMode(BusyFail))
+
+	f, err := fsys.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, err := range map[string]error{
+		"Remove":    fsys.Remove("/dir/file.txt"),
+		"RemoveAll": fsys.RemoveAll("/dir"),
+		"Rename":    fsys.Rename("/dir/file.txt", "/renamed.txt"),
+		"Truncate":  fsys.Truncate("/dir/file.txt", 0),
+	} {
+		if !errors.Is(err, syscall.EBUSY) {
+			t.Errorf("%s: expected EBUSY, got %v", name, err)
+		}
+	}
+
+	// Other paths are not affected.
+	if err := fsys.Mkdir("/other", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/other", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+	if err := fsys.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBusyModeWait tests that removing a path with open files waits for them
+// to be closed in BusyWait mode.
+func TestBusyModeWait(t *testing.T) {
+	fsys := newShareFS(t, WithBusyMode(BusyWait))
+
+	f, err := fsys.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := fsys.WithContext(ctx).Remove("/dir/file.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Remove to wait, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fsys.RemoveAll("/dir")
+	}()
+
+	// The open file remains usable while RemoveAll waits.
+	buf := make([]byte, 1)
+	if _, err := f.Read(buf); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("RemoveAll returned while a file was open: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	f.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RemoveAll did not proceed after the file was closed")
+	}
+	if _, err := fsys.Stat("/dir"); !os.IsNotExist(err) {
+		t.Fatalf("expected /dir to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package lockfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+
+	"github.com/absfs/absfs"
+)
+
+// ImportTar replaces the tree rooted at root in fsys with the contents of the
+// tar archive read from r. Entry names are taken relative to root; names
+// that would escape it are confined to it.
+//
+// The archive is first extracted into a staging directory next to root,
+// which is then swapped into place. If fsys is a wrapper from this package
+// the swap happens under its write lock, honoring advisory locks, share
+// modes and the busy mode as RemoveAll and Rename do, so readers see either
+// the old tree or the whole new one. Other filesystems are swapped without
+// any locking. If extraction or the swap fails, root is left untouched.
+func ImportTar(fsys absfs.Filer, root string, r io.Reader) error {
+	root = path.Clean(root)
+	if root == "/" || root == "." {
+		return &os.PathError{Op: "import", Path: root, Err: os.ErrInvalid}
+	}
+	efs := absfs.ExtendFiler(fsys)
+	if err := efs.MkdirAll(path.Dir(root), 0755); err != nil {
+		return err
+	}
+	staging := path.Join(path.Dir(root), fmt.Sprintf(".%s.import-%016x", path.Base(root), rand.Uint64()))
+	if err := efs.Mkdir(staging, 0755); err != nil {
+		return err
+	}
+	if err := extractTar(efs, staging, r); err != nil {
+		efs.RemoveAll(staging)
+		return err
+	}
+	if err := swap(fsys, root, staging); err != nil {
+		efs.RemoveAll(staging)
+		return err
+	}
+	return nil
+}
+
+// extractTar extracts the tar archive read from r into dir in fsys.
+func extractTar(fsys absfs.FileSystem, dir string, r io.Reader) error {
+	type dirTimes struct {
+		name string
+		hdr  *tar.Header
+	}
+	var dirs []dirTimes
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Join(dir, path.Clean("/"+hdr.Name))
+		mode := hdr.FileInfo().Mode()
+		if name != dir {
+			if err := fsys.MkdirAll(path.Dir(name), 0755); err != nil {
+				return err
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := fsys.MkdirAll(name, mode.Perm()); err != nil {
+				return err
+			}
+			// Directory times are set last, since extracting their
+			// children changes them.
+			dirs = append(dirs, dirTimes{name, hdr})
+		case tar.TypeReg:
+			f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			if err := fsys.Chtimes(name, hdr.AccessTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			sl, ok := fsys.(absfs.SymLinker)
+			if !ok {
+				return &os.PathError{Op: "symlink", Path: name, Err: absfs.ErrNotImplemented}
+			}
+			if err := sl.Symlink(hdr.Linkname, name); err != nil {
+				return err
+			}
+			continue
+		default:
+			return &os.PathError{Op: "import", Path: hdr.Name, Err: fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)}
+		}
+		if err := fsys.Chmod(name, mode); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := fsys.Chtimes(dirs[i].name, dirs[i].hdr.AccessTime, dirs[i].hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swap replaces root with staging, under the write lock of fsys if it is a
+// wrapper.
+func swap(fsys absfs.Filer, root, staging string) (err error) {
+	w, ok := fsys.(wrapper)
+	if !ok {
+		return replaceTree(absfs.ExtendFiler(fsys), root, staging)
+	}
+	c, ctx := w.lockCore()
+	defer c.audit(ctx, &err, AuditRecord{Op: "import", Path: root})
+	if err := c.acquireIdle(ctx, "import", true, root); err != nil {
+		return err
+	}
+	defer c.release(exclusive | mutating)
+	if c.deleteDenied(root, true) {
+		return &os.PathError{Op: "import", Path: root, Err: ErrSharingViolation}
+	}
+	err = replaceTree(absfs.ExtendFiler(c.base), root, staging)
+	c.invalidate(c.keys([]string{staging}), true)
+	return c.mutated(err, "import", true, root)
+}
+
+// replaceTree renames staging over root. The old root is first renamed to a
+// backup next to it, which is renamed back if staging cannot be moved into
+// place, and removed otherwise, so root is never lost.
+func replaceTree(fsys absfs.FileSystem, root, staging string) error {
+	backup := path.Join(path.Dir(root), fmt.Sprintf(".%s.import-old-%016x", path.Base(root), rand.Uint64()))
+	if err := fsys.Rename(root, backup); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		backup = ""
+	}
+	if err := fsys.Rename(staging, root); err != nil {
+		if backup != "" {
+			if rerr := fsys.Rename(backup, root); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+		}
+		return err
+	}
+	if backup != "" {
+		fsys.RemoveAll(backup)
+	}
+	return nil
+}
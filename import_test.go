@@ -0,0 +1,185 @@
+package lockfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// exportData returns a tar archive of /data in newExportFS.
+func exportData(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := ExportTar(newExportFS(t), "/data", &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestImportTar tests that ImportTar replaces a tree with an exported one.
+func TestImportTar(t *testing.T) {
+	fsys := newExportFS(t)
+	f, err := fsys.Create("/data/stale.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := ImportTar(fsys, "/data", bytes.NewReader(exportData(t))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fsys.Stat("/data/stale.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected the old tree to be replaced, got %v", err)
+	}
+	data, err := fsys.ReadFile("/data/sub/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", data)
+	}
+	info, err := fsys.Stat("/data/sub/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("expected mode 0640, got %v", info.Mode())
+	}
+	target, err := fsys.Readlink("/data/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "sub/file.txt" {
+		t.Errorf("expected link to sub/file.txt, got %q", target)
+	}
+
+	// Nothing is left behind next to the tree.
+	entries, err := fsys.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "data" {
+		t.Errorf("expected only /data, got %v", entries)
+	}
+}
+
+// TestImportTarNew tests that ImportTar creates a tree that does not exist.
+func TestImportTarNew(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewSymlinkFS(mfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportTar(fsys, "/restored/data", bytes.NewReader(exportData(t))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/restored/data/sub/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestImportTarConfined tests that entries cannot escape the imported tree.
+func TestImportTarConfined(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../../escape.txt", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("x"))
+	tw.Close()
+
+	fsys := newShareFS(t)
+	if err := ImportTar(fsys, "/dir", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/escape.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected the entry not to escape, got %v", err)
+	}
+	if _, err := fsys.Stat("/dir/escape.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestImportTarFailure tests that a failed import leaves the tree untouched.
+func TestImportTarFailure(t *testing.T) {
+	archive := exportData(t)
+	fsys := newExportFS(t, WithBusyMode(BusyFail))
+	f, err := fsys.Open("/data/sub/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := ImportTar(fsys, "/data", bytes.NewReader(archive)); !errors.Is(err, syscall.EBUSY) {
+		t.Fatalf("expected EBUSY, got %v", err)
+	}
+	if err := ImportTar(fsys, "/data", io.LimitReader(bytes.NewReader(archive), int64(len(archive)/2))); err == nil {
+		t.Fatal("expected a truncated archive to fail")
+	}
+	if _, err := fsys.Lstat("/data/link"); err != nil {
+		t.Errorf("expected the old tree to remain, got %v", err)
+	}
+	entries, err := fsys.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected the staging directories to be removed, got %v", entries)
+	}
+}
+
+// swapFailFS fails renames of import staging directories to /data.
+type swapFailFS struct {
+	absfs.SymlinkFileSystem
+}
+
+func (fs *swapFailFS) Rename(oldpath, newpath string) error {
+	if newpath == "/data" && !strings.Contains(oldpath, ".import-old-") {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrPermission}
+	}
+	return fs.SymlinkFileSystem.Rename(oldpath, newpath)
+}
+
+// TestImportTarSwapFailure tests that the old tree is restored if the
+// imported one cannot be moved into place.
+func TestImportTarSwapFailure(t *testing.T) {
+	archive := exportData(t)
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewSymlinkFS(&swapFailFS{mfs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.MkdirAll("/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileAtomic("/data/old.txt", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportTar(fsys, "/data", bytes.NewReader(archive)); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	if data, err := fsys.ReadFile("/data/old.txt"); err != nil || string(data) != "old" {
+		t.Errorf("expected the old tree to be restored, got %q, %v", data, err)
+	}
+	entries, err := fsys.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected the staging and backup directories to be removed, got %v", entries)
+	}
+}
@@ -0,0 +1,221 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// FS adapts a wrapper to the io/fs interfaces. It implements fs.FS,
+// fs.StatFS, fs.ReadDirFS, fs.ReadFileFS, fs.GlobFS and fs.SubFS, taking the
+// same locks as the wrapper it was created from. Glob is evaluated under a
+// single read lock.
+//
+// The wrappers cannot implement these interfaces themselves, since the Open
+// method of absfs.FileSystem returns an absfs.File rather than an fs.File.
+// Use the IOFS method of a wrapper to pass it to template.ParseFS, http.FS
+// and the like.
+type FS struct {
+	c    *core
+	ctx  context.Context
+	base baseFS
+}
+
+var (
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+	_ fs.GlobFS     = (*FS)(nil)
+	_ fs.SubFS      = (*FS)(nil)
+)
+
+// IOFS returns an FS for the wrapper, rooted at "/".
+func (f *Filer) IOFS() *FS {
+	return &FS{c: f.core, ctx: f.ctx, base: baseFS{f.fs, "/"}}
+}
+
+// IOFS returns an FS for the wrapper, rooted at "/".
+func (f *FileSystem) IOFS() *FS {
+	return &FS{c: f.core, ctx: f.ctx, base: baseFS{f.fs, "/"}}
+}
+
+// IOFS returns an FS for the wrapper, rooted at "/".
+func (f *SymlinkFileSystem) IOFS() *FS {
+	return &FS{c: f.core, ctx: f.ctx, base: baseFS{f.sfs, "/"}}
+}
+
+// sub returns an FS for the wrapper, rooted at dir.
+func (c *core) sub(ctx context.Context, base absfs.Filer, dir string) (fs.FS, error) {
+	if err := c.acquire(ctx, "sub", shared, dir); err != nil {
+		return nil, err
+	}
+	defer c.release(shared)
+	info, err := base.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "sub", Path: dir, Err: errors.New("not a directory")}
+	}
+	return &FS{c: c, ctx: ctx, base: baseFS{base, c.abs(dir)}}, nil
+}
+
+// Open opens the named file for reading. The file is a *File, so reads from
+// it take the same locks as reads from files opened through the wrapper.
+func (f *FS) Open(name string) (fs.File, error) {
+	full, err := f.base.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := f.c.openFile(f.ctx, shared, full, os.O_RDONLY, 0, f.c.defaultShare, func() (absfs.File, error) {
+		return f.base.base.OpenFile(full, os.O_RDONLY, 0)
+	})
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	return file.(fs.File), nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	full, err := f.base.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.c.acquire(f.ctx, "stat", shared, full); err != nil {
+		return nil, err
+	}
+	defer f.c.release(shared)
+	return f.base.Stat(name)
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := f.base.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.c.acquire(f.ctx, "readdir", shared, full); err != nil {
+		return nil, err
+	}
+	defer f.c.release(shared)
+	return f.base.ReadDir(name)
+}
+
+// ReadFile reads the named file and returns its contents.
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	full, err := f.base.path("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.c.acquire(f.ctx, "readfile", shared, full); err != nil {
+		return nil, err
+	}
+	defer f.c.release(shared)
+	return f.base.ReadFile(name)
+}
+
+// Glob returns the names of all files matching pattern, evaluated under a
+// single read lock so the result reflects one state of the tree.
+func (f *FS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if err := f.c.acquire(f.ctx, "glob", shared, f.base.dir); err != nil {
+		return nil, err
+	}
+	defer f.c.release(shared)
+	return fs.Glob(f.base, pattern)
+}
+
+// Sub returns an FS rooted at the named directory.
+func (f *FS) Sub(dir string) (fs.FS, error) {
+	full, err := f.base.path("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := f.c.sub(f.ctx, f.base.base, full)
+	if err != nil {
+		return nil, rename(err, dir)
+	}
+	return sub, nil
+}
+
+// baseFS adapts the wrapped filesystem to the io/fs interfaces without any
+// locking, for use while the filesystem lock is held.
+type baseFS struct {
+	base absfs.Filer
+	dir  string // directory the names are relative to
+}
+
+// path returns the path of the io/fs name in the wrapped filesystem.
+func (b baseFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(b.dir, name), nil
+}
+
+func (b baseFS) Open(name string) (fs.File, error) {
+	full, err := b.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := b.base.OpenFile(full, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	return f, nil
+}
+
+func (b baseFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := b.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := b.base.Stat(full)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	return info, nil
+}
+
+func (b baseFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := b.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := b.base.ReadDir(full)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (b baseFS) ReadFile(name string) ([]byte, error) {
+	full, err := b.path("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := b.base.ReadFile(full)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	return data, nil
+}
+
+// rename replaces the path in a *fs.PathError with the io/fs name it was
+// derived from.
+func rename(err error, name string) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &fs.PathError{Op: pathErr.Op, Path: name, Err: pathErr.Err}
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// TestIOFS tests the io/fs adapter with fstest.TestFS.
+func TestIOFS(t *testing.T) {
+	fsys := newExportFS(t)
+	if err := fstest.TestFS(fsys.IOFS(), "data/sub/file.txt", "data/link"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := fsys.Sub("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sub, "sub/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIOFSGlob tests that Glob matches files and rejects bad patterns.
+func TestIOFSGlob(t *testing.T) {
+	fsys := newExportFS(t)
+	matches, err := fs.Glob(fsys.IOFS(), "data/*/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"data/sub/file.txt"}; !reflect.DeepEqual(matches, want) {
+		t.Errorf("expected %v, got %v", want, matches)
+	}
+	if _, err := fsys.IOFS().Glob("["); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
+
+// TestIOFSLocking tests that the adapter honors advisory locks.
+func TestIOFSLocking(t *testing.T) {
+	fsys := newExportFS(t)
+	ctx := WithOwner(context.Background(), NewOwner())
+	if err := fsys.LockPath(ctx, "/data/sub/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.UnlockPath(ctx, "/data/sub/file.txt")
+
+	timeout, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	sub, err := fsys.WithContext(timeout).Sub("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(sub, "sub/file.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ReadFile to wait for the lock, got %v", err)
+	}
+	if _, err := fs.ReadFile(fsys.WithContext(ctx).IOFS(), "data/sub/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,74 @@
+package lockfs
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrJournalTooOld is returned by ChangesSince if changes after the requested
+// generation have already been dropped from the journal.
+var ErrJournalTooOld = errors.New("journal too old")
+
+// defaultJournalSize is the number of changes the journal retains unless
+// WithJournalSize is used.
+const defaultJournalSize = 1024
+
+// Change records a mutation made through a wrapper.
+type Change struct {
+	Op      string    // operation, such as "mkdir", "write" or "rename"
+	Path    string    // absolute path mutated
+	OldPath string    // absolute path renamed from, for renames
+	Tree    bool      // whether the tree beneath Path was mutated
+	Gen     uint64    // generation of the change
+	Time    time.Time // time of the change
+}
+
+// journal is a ring of the most recent changes.
+type journal struct {
+	size    int
+	ring    []Change
+	next    int    // index of the slot to record the next change in
+	dropped uint64 // generation of the most recently dropped change
+}
+
+func (j *journal) add(ch Change) {
+	if j.size <= 0 {
+		j.dropped = ch.Gen
+		return
+	}
+	if len(j.ring) < j.size {
+		j.ring = append(j.ring, ch)
+		return
+	}
+	j.dropped = j.ring[j.next].Gen
+	j.ring[j.next] = ch
+	j.next = (j.next + 1) % j.size
+}
+
+func (j *journal) since(gen uint64) ([]Change, error) {
+	if gen < j.dropped {
+		return nil, ErrJournalTooOld
+	}
+	var changes []Change
+	for i := range j.ring {
+		ch := j.ring[(j.next+i)%len(j.ring)]
+		if ch.Gen > gen {
+			changes = append(changes, ch)
+		}
+	}
+	return changes, nil
+}
+
+// ChangesSince returns the mutations made through the wrapper after
+// generation gen, oldest first, or ErrJournalTooOld if some of them have
+// been dropped from the journal. Pass the Gen of the last change seen, or
+// the result of Generation taken before a full scan, to catch up from there.
+func (c *core) ChangesSince(gen uint64) ([]Change, error) {
+	return c.gens.since(gen)
+}
+
+// Generation returns the generation of the most recent mutation made through
+// the wrapper.
+func (c *core) Generation() uint64 {
+	return c.gens.current()
+}
@@ -0,0 +1,76 @@
+package lockfs
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestChangesSince tests that ChangesSince returns the mutations made after
+// a generation, in order.
+func TestChangesSince(t *testing.T) {
+	fsys := newShareFS(t)
+	gen := fsys.Generation()
+
+	if err := fsys.Mkdir("/other", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/dir/file.txt", "/other/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := fsys.ChangesSince(gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Op: "mkdir", Path: "/other"},
+		{Op: "rename", Path: "/other/file.txt", OldPath: "/dir/file.txt", Tree: true},
+		{Op: "removeall", Path: "/dir", Tree: true},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, got %+v", len(want), changes)
+	}
+	for i, ch := range changes {
+		w := want[i]
+		if ch.Op != w.Op || ch.Path != w.Path || ch.OldPath != w.OldPath || ch.Tree != w.Tree {
+			t.Errorf("change %d: expected %+v, got %+v", i, w, ch)
+		}
+		if ch.Gen != gen+uint64(i)+1 || ch.Time.IsZero() {
+			t.Errorf("change %d: unexpected generation or time in %+v", i, ch)
+		}
+	}
+
+	changes, err = fsys.ChangesSince(changes[1].Gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Op != "removeall" {
+		t.Errorf("expected the last change only, got %+v", changes)
+	}
+}
+
+// TestChangesSinceTooOld tests that ChangesSince fails once the journal has
+// dropped changes after the requested generation.
+func TestChangesSinceTooOld(t *testing.T) {
+	fsys := newShareFS(t, WithJournalSize(2))
+	gen := fsys.Generation()
+
+	for _, name := range []string{"/a", "/b", "/c"} {
+		if err := fsys.Mkdir(name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fsys.ChangesSince(gen); !errors.Is(err, ErrJournalTooOld) {
+		t.Fatalf("expected ErrJournalTooOld, got %v", err)
+	}
+	changes, err := fsys.ChangesSince(gen + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Path != "/b" || changes[1].Path != "/c" {
+		t.Errorf("expected /b and /c, got %+v", changes)
+	}
+}
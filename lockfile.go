@@ -1,22 +1,15 @@
 package lockfs
 
 import (
+	"context"
 	"io/fs"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/absfs/absfs"
 )
 
-// locker is an interface for types that provide filesystem-level locking.
-// File uses this to coordinate with its parent filesystem wrapper.
-type locker interface {
-	rlock()
-	runlock()
-	lock()
-	unlock()
-}
-
 // File wraps an absfs.File with hierarchical locking for thread-safe access.
 //
 // File operations acquire both:
@@ -25,19 +18,60 @@ type locker interface {
 //
 // This ensures that operations like fs.Create("/file") cannot race with
 // f.Read() on an existing handle to the same file.
+//
+// Operations on a File also honor advisory locks on the path it was opened
+// at, on behalf of the Owner the file was opened by.
 type File struct {
 	f      absfs.File
 	m      sync.RWMutex
-	parent locker
+	parent *core
+
+	ctx   context.Context // carries the Owner the file was opened by
+	key   string          // absolute path the file is open at
+	flag  int             // flags the file was opened with
+	share ShareMode
+
+	closed atomic.Bool
+	syncs  syncGroup
 }
 
-// wrapFile wraps an absfs.File in a thread-safe File wrapper with hierarchical locking.
-// The parent parameter provides the filesystem-level lock for coordination.
-func wrapFile(parent locker, f absfs.File, err error) (absfs.File, error) {
-	if err != nil {
-		return nil, err
+// enter takes the filesystem read lock for operation op on the file, once no
+// advisory lock held by another owner than the file's conflicts with it. It
+// returns os.ErrClosed if the file has been closed.
+func (f *File) enter(op string, a access) error {
+	return f.enterContext(f.ctx, op, a)
+}
+
+// enterContext is like enter, but stops waiting once ctx is done.
+func (f *File) enterContext(ctx context.Context, op string, a access) error {
+	return f.parent.await(ctx, a, func() (<-chan struct{}, error) {
+		if f.closed.Load() {
+			return nil, os.ErrClosed
+		}
+		if err := f.parent.writable(op, a, f.f.Name()); err != nil {
+			return nil, err
+		}
+		wait := f.parent.admit(f.ctx, a, []string{f.key})
+		if wait == nil && a&mutating != 0 {
+			f.parent.preserve([]string{f.key}, false)
+		}
+		return wait, nil
+	})
+}
+
+// wrote records a write of n bytes to the file. The caller must hold the
+// filesystem read lock.
+func (f *File) wrote(n int) {
+	if n > 0 {
+		f.parent.mutated(nil, "write", false, f.key)
 	}
-	return &File{f: f, parent: parent}, nil
+}
+
+// audit records a mutating operation on the file in the audit log, on
+// behalf of the principal the file was opened by.
+func (f *File) audit(errp *error, rec AuditRecord) {
+	rec.Path = f.f.Name()
+	f.parent.audit(f.ctx, errp, rec)
 }
 
 // Name returns the name of the file. This is safe without locking
@@ -49,7 +83,9 @@ func (f *File) Name() string {
 // Read reads up to len(p) bytes into p.
 // Uses exclusive file lock (modifies position) with filesystem read lock.
 func (f *File) Read(p []byte) (int, error) {
-	f.parent.rlock()
+	if err := f.enter("read", shared); err != nil {
+		return 0, err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
@@ -59,7 +95,9 @@ func (f *File) Read(p []byte) (int, error) {
 // ReadAt reads len(b) bytes from the file starting at byte offset off.
 // Uses read locks on both filesystem and file (position-independent).
 func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
-	f.parent.rlock()
+	if err := f.enter("read", shared); err != nil {
+		return 0, err
+	}
 	defer f.parent.runlock()
 	f.m.RLock()
 	defer f.m.RUnlock()
@@ -68,22 +106,36 @@ func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
 
 // Write writes len(p) bytes to the file.
 // Uses exclusive locks on both filesystem and file.
-func (f *File) Write(p []byte) (int, error) {
-	f.parent.rlock()
+func (f *File) Write(p []byte) (n int, err error) {
+	if f.parent.auditLog != nil {
+		defer f.audit(&err, AuditRecord{Op: "write", Size: int64ptr(len(p))})
+	}
+	if err := f.enter("write", mutating); err != nil {
+		return 0, err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
-	return f.f.Write(p)
+	n, err = f.f.Write(p)
+	f.wrote(n)
+	return n, err
 }
 
 // WriteAt writes len(b) bytes to the file starting at byte offset off.
 // Uses filesystem read lock and exclusive file lock.
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
-	f.parent.rlock()
+	if f.parent.auditLog != nil {
+		defer f.audit(&err, AuditRecord{Op: "write", Size: int64ptr(len(b)), Offset: &off})
+	}
+	if err := f.enter("write", mutating); err != nil {
+		return 0, err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
-	return f.f.WriteAt(b, off)
+	n, err = f.f.WriteAt(b, off)
+	f.wrote(n)
+	return n, err
 }
 
 // Close closes the file.
@@ -91,13 +143,19 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 func (f *File) Close() error {
 	f.m.Lock()
 	defer f.m.Unlock()
+	if f.closed.Swap(true) {
+		return &os.PathError{Op: "close", Path: f.f.Name(), Err: os.ErrClosed}
+	}
+	f.parent.handles.remove(f)
 	return f.f.Close()
 }
 
 // Seek sets the offset for the next Read or Write.
 // Uses exclusive file lock (modifies position) with filesystem read lock.
 func (f *File) Seek(offset int64, whence int) (ret int64, err error) {
-	f.parent.rlock()
+	if err := f.enter("seek", shared); err != nil {
+		return 0, err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
@@ -107,7 +165,9 @@ func (f *File) Seek(offset int64, whence int) (ret int64, err error) {
 // Stat returns the FileInfo for the file.
 // Uses read locks on both filesystem and file.
 func (f *File) Stat() (os.FileInfo, error) {
-	f.parent.rlock()
+	if err := f.enter("stat", shared); err != nil {
+		return nil, err
+	}
 	defer f.parent.runlock()
 	f.m.RLock()
 	defer f.m.RUnlock()
@@ -115,9 +175,25 @@ func (f *File) Stat() (os.FileInfo, error) {
 }
 
 // Sync commits the file's contents to stable storage.
-// Uses filesystem read lock and exclusive file lock.
+// Uses filesystem read lock and exclusive file lock. If the wrapper was
+// created with WithGroupSync, concurrent calls share one underlying Sync.
 func (f *File) Sync() error {
-	f.parent.rlock()
+	return f.syncContext(f.ctx)
+}
+
+// syncContext is like Sync, but stops waiting once ctx is done.
+func (f *File) syncContext(ctx context.Context) error {
+	if f.parent.groupSync {
+		return f.groupSync(ctx)
+	}
+	return f.sync(ctx)
+}
+
+// sync calls Sync on the underlying file.
+func (f *File) sync(ctx context.Context) error {
+	if err := f.enterContext(ctx, "sync", flushing); err != nil {
+		return err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
@@ -127,7 +203,9 @@ func (f *File) Sync() error {
 // Readdir reads the contents of the directory.
 // Uses exclusive file lock (modifies directory cursor) with filesystem read lock.
 func (f *File) Readdir(n int) ([]os.FileInfo, error) {
-	f.parent.rlock()
+	if err := f.enter("readdir", shared); err != nil {
+		return nil, err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
@@ -137,7 +215,9 @@ func (f *File) Readdir(n int) ([]os.FileInfo, error) {
 // Readdirnames reads the names of directory entries.
 // Uses exclusive file lock (modifies directory cursor) with filesystem read lock.
 func (f *File) Readdirnames(n int) ([]string, error) {
-	f.parent.rlock()
+	if err := f.enter("readdir", shared); err != nil {
+		return nil, err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
@@ -146,22 +226,34 @@ func (f *File) Readdirnames(n int) ([]string, error) {
 
 // Truncate changes the size of the file.
 // Uses filesystem read lock and exclusive file lock.
-func (f *File) Truncate(size int64) error {
-	f.parent.rlock()
+func (f *File) Truncate(size int64) (err error) {
+	if f.parent.auditLog != nil {
+		defer f.audit(&err, AuditRecord{Op: "truncate", Size: &size})
+	}
+	if err := f.enter("truncate", mutating); err != nil {
+		return err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
-	return f.f.Truncate(size)
+	return f.parent.mutated(f.f.Truncate(size), "truncate", false, f.key)
 }
 
 // WriteString writes a string to the file.
 // Uses filesystem read lock and exclusive file lock.
 func (f *File) WriteString(s string) (n int, err error) {
-	f.parent.rlock()
+	if f.parent.auditLog != nil {
+		defer f.audit(&err, AuditRecord{Op: "write", Size: int64ptr(len(s))})
+	}
+	if err := f.enter("write", mutating); err != nil {
+		return 0, err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
-	return f.f.WriteString(s)
+	n, err = f.f.WriteString(s)
+	f.wrote(n)
+	return n, err
 }
 
 // ReadDir reads the contents of the directory associated with file and
@@ -170,7 +262,9 @@ func (f *File) WriteString(s string) (n int, err error) {
 // the directory in a single slice.
 // Uses exclusive file lock (modifies directory cursor) with filesystem read lock.
 func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
-	f.parent.rlock()
+	if err := f.enter("readdir", shared); err != nil {
+		return nil, err
+	}
 	defer f.parent.runlock()
 	f.m.Lock()
 	defer f.m.Unlock()
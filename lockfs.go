@@ -1,9 +1,9 @@
 package lockfs
 
 import (
+	"context"
 	"io/fs"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/absfs/absfs"
@@ -13,101 +13,133 @@ import (
 // Read operations (Stat) use RLock for concurrent access, write operations use Lock.
 // Files returned from OpenFile use hierarchical locking to coordinate with the Filer.
 type Filer struct {
-	fs absfs.Filer
-	m  sync.RWMutex
+	*core
+	fs  absfs.Filer
+	ctx context.Context
 }
 
-// locker interface implementation for hierarchical locking
-func (f *Filer) rlock()   { f.m.RLock() }
-func (f *Filer) runlock() { f.m.RUnlock() }
-func (f *Filer) lock()    { f.m.Lock() }
-func (f *Filer) unlock()  { f.m.Unlock() }
-
 // NewFiler creates a new thread-safe Filer wrapper.
-func NewFiler(filer absfs.Filer) (*Filer, error) {
-	return &Filer{fs: filer}, nil
+func NewFiler(filer absfs.Filer, opts ...Option) (*Filer, error) {
+	c, err := newCore(filer, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Filer{core: c, fs: filer, ctx: context.Background()}, nil
+}
+
+// WithContext returns a view of f that performs its operations on behalf of
+// the Owner carried by ctx, and gives up waiting for advisory locks when ctx
+// is done. The view shares all locks with f.
+func (f *Filer) WithContext(ctx context.Context) *Filer {
+	return &Filer{core: f.core, fs: f.fs, ctx: ctx}
 }
 
 // OpenFile opens a file using the given flags and the given mode.
 // The returned File is wrapped for thread-safe access with hierarchical locking.
 func (f *Filer) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
-	f.m.Lock()
-	defer f.m.Unlock()
-	file, err := f.fs.OpenFile(name, flag, perm)
-	return wrapFile(f, file, err)
+	return f.OpenFileShare(name, flag, perm, f.defaultShare)
+}
+
+// OpenFileShare is like OpenFile, but opens the file with the share mode
+// share rather than the default one. See WithShareModes.
+func (f *Filer) OpenFileShare(name string, flag int, perm os.FileMode, share ShareMode) (absfs.File, error) {
+	return f.openFile(f.ctx, openAccess(flag), name, flag, perm, share, func() (absfs.File, error) {
+		return f.fs.OpenFile(name, flag, perm)
+	})
 }
 
 // Mkdir creates a directory in the filesystem, return an error if any
 // happens.
-func (f *Filer) Mkdir(name string, perm os.FileMode) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Mkdir(name, perm)
+func (f *Filer) Mkdir(name string, perm os.FileMode) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "mkdir", Path: name, Mode: &perm})
+	if err := f.acquire(f.ctx, "mkdir", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.Mkdir(name, perm), "mkdir", false, name)
 }
 
 // Remove removes a file identified by name, returning an error, if any
 // happens.
-func (f *Filer) Remove(name string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Remove(name)
+func (f *Filer) Remove(name string) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "remove", Path: name})
+	if err := f.acquireIdle(f.ctx, "remove", false, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.deleteDenied(name, false) {
+		return &os.PathError{Op: "remove", Path: name, Err: ErrSharingViolation}
+	}
+	return f.mutated(f.fs.Remove(name), "remove", false, name)
 }
 
 // Rename renames (moves) oldpath to newpath.
-func (f *Filer) Rename(oldpath, newpath string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Rename(oldpath, newpath)
+func (f *Filer) Rename(oldpath, newpath string) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "rename", Path: oldpath, NewPath: newpath})
+	if err := f.acquireIdle(f.ctx, "rename", true, oldpath, newpath); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.deleteDenied(oldpath, true) || f.deleteDenied(newpath, true) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrSharingViolation}
+	}
+	if err := f.fs.Rename(oldpath, newpath); err != nil {
+		return f.mutated(err, "rename", true, oldpath, newpath)
+	}
+	f.renamed(oldpath, newpath)
+	return nil
 }
 
 // Stat returns the FileInfo structure describing file. If there is an error,
 // it will be of type *PathError.
 func (f *Filer) Stat(name string) (os.FileInfo, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.fs.Stat(name)
+	return readCommitted(f.core, f.ctx, "stat", name, f.cachedStat, snapshotInfo)
 }
 
 // Chmod changes the mode of the named file to mode.
-func (f *Filer) Chmod(name string, mode os.FileMode) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Chmod(name, mode)
+func (f *Filer) Chmod(name string, mode os.FileMode) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chmod", Path: name, Mode: &mode})
+	if err := f.acquire(f.ctx, "chmod", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.Chmod(name, mode), "chmod", false, name)
 }
 
 // Chtimes changes the access and modification times of the named file.
-func (f *Filer) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Chtimes(name, atime, mtime)
+func (f *Filer) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chtimes", Path: name, Atime: &atime, Mtime: &mtime})
+	if err := f.acquire(f.ctx, "chtimes", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.Chtimes(name, atime, mtime), "chtimes", false, name)
 }
 
 // Chown changes the owner and group ids of the named file.
-func (f *Filer) Chown(name string, uid, gid int) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Chown(name, uid, gid)
+func (f *Filer) Chown(name string, uid, gid int) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chown", Path: name, UID: &uid, GID: &gid})
+	if err := f.acquire(f.ctx, "chown", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.Chown(name, uid, gid), "chown", false, name)
 }
 
 // ReadDir reads the named directory and returns all its directory entries.
 func (f *Filer) ReadDir(name string) ([]fs.DirEntry, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.fs.ReadDir(name)
+	return readCommitted(f.core, f.ctx, "readdir", name, f.cachedReadDir, cloneEntries)
 }
 
 // ReadFile reads the named file and returns its contents.
 func (f *Filer) ReadFile(name string) ([]byte, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.fs.ReadFile(name)
+	return readCommitted(f.core, f.ctx, "readfile", name, f.cachedReadFile, cloneBytes)
 }
 
-// Sub returns a filesystem corresponding to the subtree rooted at dir.
+// Sub returns a filesystem corresponding to the subtree rooted at dir. The
+// result is an *FS, which takes the same locks as the wrapper.
 func (f *Filer) Sub(dir string) (fs.FS, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return absfs.FilerToFS(f.fs, dir)
+	return f.sub(f.ctx, f.fs, dir)
 }
 
 // FileSystem wraps an absfs.FileSystem with a RWMutex for thread-safe access.
@@ -115,93 +147,134 @@ func (f *Filer) Sub(dir string) (fs.FS, error) {
 // Files returned from Open/Create/OpenFile use hierarchical locking to coordinate
 // with the FileSystem, preventing races between file operations and filesystem mutations.
 type FileSystem struct {
-	m  sync.RWMutex
-	fs absfs.FileSystem
+	*core
+	fs  absfs.FileSystem
+	ctx context.Context
 }
 
-// locker interface implementation for hierarchical locking
-func (f *FileSystem) rlock()   { f.m.RLock() }
-func (f *FileSystem) runlock() { f.m.RUnlock() }
-func (f *FileSystem) lock()    { f.m.Lock() }
-func (f *FileSystem) unlock()  { f.m.Unlock() }
-
 // NewFS creates a new thread-safe FileSystem wrapper.
-func NewFS(fs absfs.FileSystem) (*FileSystem, error) {
-	return &FileSystem{fs: fs}, nil
+func NewFS(fs absfs.FileSystem, opts ...Option) (*FileSystem, error) {
+	c, err := newCore(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSystem{core: c, fs: fs, ctx: context.Background()}, nil
+}
+
+// WithContext returns a view of f that performs its operations on behalf of
+// the Owner carried by ctx, and gives up waiting for advisory locks when ctx
+// is done. The view shares all locks with f.
+func (f *FileSystem) WithContext(ctx context.Context) *FileSystem {
+	return &FileSystem{core: f.core, fs: f.fs, ctx: ctx}
 }
 
 // OpenFile opens a file using the given flags and the given mode.
 // The returned File is wrapped for thread-safe access with hierarchical locking.
 func (f *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
-	f.m.Lock()
-	defer f.m.Unlock()
-	file, err := f.fs.OpenFile(name, flag, perm)
-	return wrapFile(f, file, err)
+	return f.OpenFileShare(name, flag, perm, f.defaultShare)
+}
+
+// OpenFileShare is like OpenFile, but opens the file with the share mode
+// share rather than the default one. See WithShareModes.
+func (f *FileSystem) OpenFileShare(name string, flag int, perm os.FileMode, share ShareMode) (absfs.File, error) {
+	return f.openFile(f.ctx, openAccess(flag), name, flag, perm, share, func() (absfs.File, error) {
+		return f.fs.OpenFile(name, flag, perm)
+	})
 }
 
 // Mkdir creates a directory in the filesystem, return an error if any
 // happens.
-func (f *FileSystem) Mkdir(name string, perm os.FileMode) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Mkdir(name, perm)
+func (f *FileSystem) Mkdir(name string, perm os.FileMode) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "mkdir", Path: name, Mode: &perm})
+	if err := f.acquire(f.ctx, "mkdir", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.Mkdir(name, perm), "mkdir", false, name)
 }
 
 // Remove removes a file identified by name, returning an error, if any
 // happens.
-func (f *FileSystem) Remove(name string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Remove(name)
+func (f *FileSystem) Remove(name string) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "remove", Path: name})
+	if err := f.acquireIdle(f.ctx, "remove", false, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.deleteDenied(name, false) {
+		return &os.PathError{Op: "remove", Path: name, Err: ErrSharingViolation}
+	}
+	return f.mutated(f.fs.Remove(name), "remove", false, name)
 }
 
 // Rename renames (moves) oldpath to newpath.
-func (f *FileSystem) Rename(oldpath, newpath string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Rename(oldpath, newpath)
+func (f *FileSystem) Rename(oldpath, newpath string) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "rename", Path: oldpath, NewPath: newpath})
+	if err := f.acquireIdle(f.ctx, "rename", true, oldpath, newpath); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.deleteDenied(oldpath, true) || f.deleteDenied(newpath, true) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrSharingViolation}
+	}
+	if err := f.fs.Rename(oldpath, newpath); err != nil {
+		return f.mutated(err, "rename", true, oldpath, newpath)
+	}
+	f.renamed(oldpath, newpath)
+	return nil
 }
 
 // Stat returns the FileInfo structure describing file. If there is an error,
 // it will be of type *PathError.
 func (f *FileSystem) Stat(name string) (os.FileInfo, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.fs.Stat(name)
+	return readCommitted(f.core, f.ctx, "stat", name, f.cachedStat, snapshotInfo)
 }
 
 // Chmod changes the mode of the named file to mode.
-func (f *FileSystem) Chmod(name string, mode os.FileMode) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Chmod(name, mode)
+func (f *FileSystem) Chmod(name string, mode os.FileMode) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chmod", Path: name, Mode: &mode})
+	if err := f.acquire(f.ctx, "chmod", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.Chmod(name, mode), "chmod", false, name)
 }
 
 // Chtimes changes the access and modification times of the named file.
-func (f *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Chtimes(name, atime, mtime)
+func (f *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chtimes", Path: name, Atime: &atime, Mtime: &mtime})
+	if err := f.acquire(f.ctx, "chtimes", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.Chtimes(name, atime, mtime), "chtimes", false, name)
 }
 
 // Chown changes the owner and group ids of the named file.
-func (f *FileSystem) Chown(name string, uid, gid int) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Chown(name, uid, gid)
+func (f *FileSystem) Chown(name string, uid, gid int) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chown", Path: name, UID: &uid, GID: &gid})
+	if err := f.acquire(f.ctx, "chown", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.Chown(name, uid, gid), "chown", false, name)
 }
 
 // Chdir changes the current working directory.
 func (f *FileSystem) Chdir(dir string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
+	if err := f.acquire(f.ctx, "chdir", exclusive, dir); err != nil {
+		return err
+	}
+	defer f.release(exclusive)
 	return f.fs.Chdir(dir)
 }
 
 // Getwd returns the current working directory.
 func (f *FileSystem) Getwd() (dir string, err error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
+	if err := f.acquire(f.ctx, "getwd", shared); err != nil {
+		return "", err
+	}
+	defer f.release(shared)
 	return f.fs.Getwd()
 }
 
@@ -213,61 +286,69 @@ func (f *FileSystem) TempDir() string {
 // Open opens the named file for reading.
 // The returned File is wrapped for thread-safe access with hierarchical locking.
 func (f *FileSystem) Open(name string) (absfs.File, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	file, err := f.fs.Open(name)
-	return wrapFile(f, file, err)
+	return f.openFile(f.ctx, shared, name, os.O_RDONLY, 0, f.defaultShare, func() (absfs.File, error) {
+		return f.fs.Open(name)
+	})
 }
 
 // Create creates the named file, truncating it if it already exists.
 // The returned File is wrapped for thread-safe access with hierarchical locking.
 func (f *FileSystem) Create(name string) (absfs.File, error) {
-	f.m.Lock()
-	defer f.m.Unlock()
-	file, err := f.fs.Create(name)
-	return wrapFile(f, file, err)
+	return f.openFile(f.ctx, exclusive|mutating, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, f.defaultShare, func() (absfs.File, error) {
+		return f.fs.Create(name)
+	})
 }
 
 // MkdirAll creates a directory named path, along with any necessary parents.
-func (f *FileSystem) MkdirAll(name string, perm os.FileMode) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.MkdirAll(name, perm)
+func (f *FileSystem) MkdirAll(name string, perm os.FileMode) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "mkdirall", Path: name, Mode: &perm})
+	if err := f.acquire(f.ctx, "mkdir", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.fs.MkdirAll(name, perm), "mkdir", false, name)
 }
 
 // RemoveAll removes path and any children it contains.
 func (f *FileSystem) RemoveAll(path string) (err error) {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.RemoveAll(path)
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "removeall", Path: path})
+	if err := f.acquireIdle(f.ctx, "removeall", true, path); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.deleteDenied(path, true) {
+		return &os.PathError{Op: "removeall", Path: path, Err: ErrSharingViolation}
+	}
+	return f.mutated(f.fs.RemoveAll(path), "removeall", true, path)
 }
 
 // Truncate changes the size of the named file.
-func (f *FileSystem) Truncate(name string, size int64) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.fs.Truncate(name, size)
+func (f *FileSystem) Truncate(name string, size int64) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "truncate", Path: name, Size: &size})
+	if err := f.acquireIdle(f.ctx, "truncate", false, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.shareModes && f.handles.denies(f.abs(name), false, DenyWrite) {
+		return &os.PathError{Op: "truncate", Path: name, Err: ErrSharingViolation}
+	}
+	return f.mutated(f.fs.Truncate(name, size), "truncate", false, name)
 }
 
 // ReadDir reads the named directory and returns all its directory entries.
 func (f *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.fs.ReadDir(name)
+	return readCommitted(f.core, f.ctx, "readdir", name, f.cachedReadDir, cloneEntries)
 }
 
 // ReadFile reads the named file and returns its contents.
 func (f *FileSystem) ReadFile(name string) ([]byte, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.fs.ReadFile(name)
+	return readCommitted(f.core, f.ctx, "readfile", name, f.cachedReadFile, cloneBytes)
 }
 
-// Sub returns a filesystem corresponding to the subtree rooted at dir.
+// Sub returns a filesystem corresponding to the subtree rooted at dir. The
+// result is an *FS, which takes the same locks as the wrapper.
 func (f *FileSystem) Sub(dir string) (fs.FS, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return absfs.FilerToFS(f.fs, dir)
+	return f.sub(f.ctx, f.fs, dir)
 }
 
 // SymlinkFileSystem wraps an absfs.SymlinkFileSystem with a RWMutex for thread-safe access.
@@ -275,93 +356,134 @@ func (f *FileSystem) Sub(dir string) (fs.FS, error) {
 // Files returned from Open/Create/OpenFile use hierarchical locking to coordinate
 // with the SymlinkFileSystem, preventing races between file operations and filesystem mutations.
 type SymlinkFileSystem struct {
-	m   sync.RWMutex
+	*core
 	sfs absfs.SymlinkFileSystem
+	ctx context.Context
 }
 
-// locker interface implementation for hierarchical locking
-func (f *SymlinkFileSystem) rlock()   { f.m.RLock() }
-func (f *SymlinkFileSystem) runlock() { f.m.RUnlock() }
-func (f *SymlinkFileSystem) lock()    { f.m.Lock() }
-func (f *SymlinkFileSystem) unlock()  { f.m.Unlock() }
-
 // NewSymlinkFS creates a new thread-safe SymlinkFileSystem wrapper.
-func NewSymlinkFS(fs absfs.SymlinkFileSystem) (*SymlinkFileSystem, error) {
-	return &SymlinkFileSystem{sfs: fs}, nil
+func NewSymlinkFS(fs absfs.SymlinkFileSystem, opts ...Option) (*SymlinkFileSystem, error) {
+	c, err := newCore(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &SymlinkFileSystem{core: c, sfs: fs, ctx: context.Background()}, nil
+}
+
+// WithContext returns a view of f that performs its operations on behalf of
+// the Owner carried by ctx, and gives up waiting for advisory locks when ctx
+// is done. The view shares all locks with f.
+func (f *SymlinkFileSystem) WithContext(ctx context.Context) *SymlinkFileSystem {
+	return &SymlinkFileSystem{core: f.core, sfs: f.sfs, ctx: ctx}
 }
 
 // OpenFile opens a file using the given flags and the given mode.
 // The returned File is wrapped for thread-safe access with hierarchical locking.
 func (f *SymlinkFileSystem) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
-	f.m.Lock()
-	defer f.m.Unlock()
-	file, err := f.sfs.OpenFile(name, flag, perm)
-	return wrapFile(f, file, err)
+	return f.OpenFileShare(name, flag, perm, f.defaultShare)
+}
+
+// OpenFileShare is like OpenFile, but opens the file with the share mode
+// share rather than the default one. See WithShareModes.
+func (f *SymlinkFileSystem) OpenFileShare(name string, flag int, perm os.FileMode, share ShareMode) (absfs.File, error) {
+	return f.openFile(f.ctx, openAccess(flag), name, flag, perm, share, func() (absfs.File, error) {
+		return f.sfs.OpenFile(name, flag, perm)
+	})
 }
 
 // Mkdir creates a directory in the filesystem, return an error if any
 // happens.
-func (f *SymlinkFileSystem) Mkdir(name string, perm os.FileMode) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Mkdir(name, perm)
+func (f *SymlinkFileSystem) Mkdir(name string, perm os.FileMode) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "mkdir", Path: name, Mode: &perm})
+	if err := f.acquire(f.ctx, "mkdir", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.sfs.Mkdir(name, perm), "mkdir", false, name)
 }
 
 // Remove removes a file identified by name, returning an error, if any
 // happens.
-func (f *SymlinkFileSystem) Remove(name string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Remove(name)
+func (f *SymlinkFileSystem) Remove(name string) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "remove", Path: name})
+	if err := f.acquireIdle(f.ctx, "remove", false, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.deleteDenied(name, false) {
+		return &os.PathError{Op: "remove", Path: name, Err: ErrSharingViolation}
+	}
+	return f.mutated(f.sfs.Remove(name), "remove", false, name)
 }
 
 // Rename renames (moves) oldpath to newpath.
-func (f *SymlinkFileSystem) Rename(oldpath, newpath string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Rename(oldpath, newpath)
+func (f *SymlinkFileSystem) Rename(oldpath, newpath string) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "rename", Path: oldpath, NewPath: newpath})
+	if err := f.acquireIdle(f.ctx, "rename", true, oldpath, newpath); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.deleteDenied(oldpath, true) || f.deleteDenied(newpath, true) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrSharingViolation}
+	}
+	if err := f.sfs.Rename(oldpath, newpath); err != nil {
+		return f.mutated(err, "rename", true, oldpath, newpath)
+	}
+	f.renamed(oldpath, newpath)
+	return nil
 }
 
 // Stat returns the FileInfo structure describing file. If there is an error,
 // it will be of type *PathError.
 func (f *SymlinkFileSystem) Stat(name string) (os.FileInfo, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.sfs.Stat(name)
+	return readCommitted(f.core, f.ctx, "stat", name, f.cachedStat, snapshotInfo)
 }
 
 // Chmod changes the mode of the named file to mode.
-func (f *SymlinkFileSystem) Chmod(name string, mode os.FileMode) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Chmod(name, mode)
+func (f *SymlinkFileSystem) Chmod(name string, mode os.FileMode) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chmod", Path: name, Mode: &mode})
+	if err := f.acquire(f.ctx, "chmod", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.sfs.Chmod(name, mode), "chmod", false, name)
 }
 
 // Chtimes changes the access and modification times of the named file.
-func (f *SymlinkFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Chtimes(name, atime, mtime)
+func (f *SymlinkFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chtimes", Path: name, Atime: &atime, Mtime: &mtime})
+	if err := f.acquire(f.ctx, "chtimes", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.sfs.Chtimes(name, atime, mtime), "chtimes", false, name)
 }
 
 // Chown changes the owner and group ids of the named file.
-func (f *SymlinkFileSystem) Chown(name string, uid, gid int) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Chown(name, uid, gid)
+func (f *SymlinkFileSystem) Chown(name string, uid, gid int) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "chown", Path: name, UID: &uid, GID: &gid})
+	if err := f.acquire(f.ctx, "chown", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.sfs.Chown(name, uid, gid), "chown", false, name)
 }
 
 // Chdir changes the current working directory.
 func (f *SymlinkFileSystem) Chdir(dir string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
+	if err := f.acquire(f.ctx, "chdir", exclusive, dir); err != nil {
+		return err
+	}
+	defer f.release(exclusive)
 	return f.sfs.Chdir(dir)
 }
 
 // Getwd returns the current working directory.
 func (f *SymlinkFileSystem) Getwd() (dir string, err error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
+	if err := f.acquire(f.ctx, "getwd", shared); err != nil {
+		return "", err
+	}
+	defer f.release(shared)
 	return f.sfs.Getwd()
 }
 
@@ -373,70 +495,80 @@ func (f *SymlinkFileSystem) TempDir() string {
 // Open opens the named file for reading.
 // The returned File is wrapped for thread-safe access with hierarchical locking.
 func (f *SymlinkFileSystem) Open(name string) (absfs.File, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	file, err := f.sfs.Open(name)
-	return wrapFile(f, file, err)
+	return f.openFile(f.ctx, shared, name, os.O_RDONLY, 0, f.defaultShare, func() (absfs.File, error) {
+		return f.sfs.Open(name)
+	})
 }
 
 // Create creates the named file, truncating it if it already exists.
 // The returned File is wrapped for thread-safe access with hierarchical locking.
 func (f *SymlinkFileSystem) Create(name string) (absfs.File, error) {
-	f.m.Lock()
-	defer f.m.Unlock()
-	file, err := f.sfs.Create(name)
-	return wrapFile(f, file, err)
+	return f.openFile(f.ctx, exclusive|mutating, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, f.defaultShare, func() (absfs.File, error) {
+		return f.sfs.Create(name)
+	})
 }
 
 // MkdirAll creates a directory named path, along with any necessary parents.
-func (f *SymlinkFileSystem) MkdirAll(name string, perm os.FileMode) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.MkdirAll(name, perm)
+func (f *SymlinkFileSystem) MkdirAll(name string, perm os.FileMode) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "mkdirall", Path: name, Mode: &perm})
+	if err := f.acquire(f.ctx, "mkdir", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.sfs.MkdirAll(name, perm), "mkdir", false, name)
 }
 
 // RemoveAll removes path and any children it contains.
 func (f *SymlinkFileSystem) RemoveAll(path string) (err error) {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.RemoveAll(path)
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "removeall", Path: path})
+	if err := f.acquireIdle(f.ctx, "removeall", true, path); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.deleteDenied(path, true) {
+		return &os.PathError{Op: "removeall", Path: path, Err: ErrSharingViolation}
+	}
+	return f.mutated(f.sfs.RemoveAll(path), "removeall", true, path)
 }
 
 // Truncate changes the size of the named file.
-func (f *SymlinkFileSystem) Truncate(name string, size int64) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Truncate(name, size)
+func (f *SymlinkFileSystem) Truncate(name string, size int64) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "truncate", Path: name, Size: &size})
+	if err := f.acquireIdle(f.ctx, "truncate", false, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	if f.shareModes && f.handles.denies(f.abs(name), false, DenyWrite) {
+		return &os.PathError{Op: "truncate", Path: name, Err: ErrSharingViolation}
+	}
+	return f.mutated(f.sfs.Truncate(name, size), "truncate", false, name)
 }
 
 // ReadDir reads the named directory and returns all its directory entries.
 func (f *SymlinkFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.sfs.ReadDir(name)
+	return readCommitted(f.core, f.ctx, "readdir", name, f.cachedReadDir, cloneEntries)
 }
 
 // ReadFile reads the named file and returns its contents.
 func (f *SymlinkFileSystem) ReadFile(name string) ([]byte, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.sfs.ReadFile(name)
+	return readCommitted(f.core, f.ctx, "readfile", name, f.cachedReadFile, cloneBytes)
 }
 
-// Sub returns a filesystem corresponding to the subtree rooted at dir.
+// Sub returns a filesystem corresponding to the subtree rooted at dir. The
+// result is an *FS, which takes the same locks as the wrapper.
 func (f *SymlinkFileSystem) Sub(dir string) (fs.FS, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return absfs.FilerToFS(f.sfs, dir)
+	return f.sub(f.ctx, f.sfs, dir)
 }
 
 // Lstat returns a FileInfo describing the named file. If the file is a
 // symbolic link, the returned FileInfo describes the symbolic link. Lstat
 // makes no attempt to follow the link. If there is an error, it will be of type *PathError.
 func (f *SymlinkFileSystem) Lstat(name string) (os.FileInfo, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.sfs.Lstat(name)
+	if err := f.acquire(f.ctx, "lstat", shared, name); err != nil {
+		return nil, err
+	}
+	defer f.release(shared)
+	return f.cachedLstat(name)
 }
 
 // Lchown changes the numeric uid and gid of the named file. If the file is a
@@ -445,24 +577,32 @@ func (f *SymlinkFileSystem) Lstat(name string) (os.FileInfo, error) {
 //
 // On Windows, it always returns the syscall.EWINDOWS error, wrapped in
 // *PathError.
-func (f *SymlinkFileSystem) Lchown(name string, uid, gid int) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Lchown(name, uid, gid)
+func (f *SymlinkFileSystem) Lchown(name string, uid, gid int) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "lchown", Path: name, UID: &uid, GID: &gid})
+	if err := f.acquire(f.ctx, "lchown", exclusive|mutating, name); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.sfs.Lchown(name, uid, gid), "lchown", false, name)
 }
 
 // Readlink returns the destination of the named symbolic link. If there is an
 // error, it will be of type *PathError.
 func (f *SymlinkFileSystem) Readlink(name string) (string, error) {
-	f.m.RLock()
-	defer f.m.RUnlock()
-	return f.sfs.Readlink(name)
+	if err := f.acquire(f.ctx, "readlink", shared, name); err != nil {
+		return "", err
+	}
+	defer f.release(shared)
+	return f.cachedReadlink(name)
 }
 
 // Symlink creates newname as a symbolic link to oldname. If there is an
 // error, it will be of type *LinkError.
-func (f *SymlinkFileSystem) Symlink(oldname, newname string) error {
-	f.m.Lock()
-	defer f.m.Unlock()
-	return f.sfs.Symlink(oldname, newname)
+func (f *SymlinkFileSystem) Symlink(oldname, newname string) (err error) {
+	defer f.audit(f.ctx, &err, AuditRecord{Op: "symlink", Path: oldname, NewPath: newname})
+	if err := f.acquire(f.ctx, "symlink", exclusive|mutating, newname); err != nil {
+		return err
+	}
+	defer f.release(exclusive | mutating)
+	return f.mutated(f.sfs.Symlink(oldname, newname), "symlink", false, newname)
 }
@@ -0,0 +1,314 @@
+package lockfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// metaCache caches the results of Stat, Lstat, ReadDir and Readlink calls,
+// and the paths Stat and Open found not to exist. Entries are dropped by the
+// mutations made through the wrapper, so it only serves results while the
+// wrapped filesystem is not mutated by others.
+type metaCache struct {
+	stats  bool // serve Stat, Lstat, ReadDir and Readlink results
+	misses bool // serve not-exist results of Stat and Open
+
+	mu      sync.Mutex
+	entries map[string]*metaEntry
+
+	// epoch counts invalidations, so results read while a mutation made
+	// under the filesystem read lock, such as a write, are not cached.
+	epoch uint64
+}
+
+// metaEntry holds the cached results for a path.
+type metaEntry struct {
+	stat, lstat fs.FileInfo
+	dir         []fs.DirEntry
+	listed      bool
+	link        string
+	linked      bool
+	missing     error // cause of the not-exist error for the path, if cached
+}
+
+// metaCache returns the metadata cache, creating it if needed.
+func (c *core) metaCache() *metaCache {
+	if c.meta == nil {
+		c.meta = &metaCache{}
+	}
+	return c.meta
+}
+
+// load returns the entry for key, or nil. The caller must hold m.mu.
+func (m *metaCache) load(key string) *metaEntry {
+	return m.entries[key]
+}
+
+// store returns the entry for key to record results in, or nil if the cache
+// was invalidated after epoch. The caller must hold m.mu.
+func (m *metaCache) store(key string, epoch uint64) *metaEntry {
+	if epoch != m.epoch {
+		return nil
+	}
+	if m.entries == nil {
+		m.entries = make(map[string]*metaEntry)
+	}
+	e := m.entries[key]
+	if e == nil {
+		e = &metaEntry{}
+		m.entries[key] = e
+	}
+	return e
+}
+
+// current returns the number of invalidations so far, to record results
+// read from then on with.
+func (m *metaCache) current() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.epoch
+}
+
+// missed returns the cause of the not-exist error cached for key, or nil.
+func (m *metaCache) missed(key string) error {
+	if !m.misses {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.load(key); e != nil {
+		return e.missing
+	}
+	return nil
+}
+
+// miss caches err as the result of a lookup of key read since invalidation
+// epoch, if it reports that key does not exist.
+func (m *metaCache) miss(key string, epoch uint64, err error) {
+	if !m.misses || !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.store(key, epoch); e != nil {
+		e.missing = err
+	}
+}
+
+// cached looks a result up with get, under the cache lock. On a miss, it
+// reads the result with read, without the cache lock, and records it with
+// put unless the cache was invalidated meanwhile. The caller must hold the
+// filesystem lock.
+func cached[T any](c *core, key string, get func(*metaEntry) (T, bool), read func() (T, error), put func(*metaEntry, T)) (T, error) {
+	m := c.meta
+	m.mu.Lock()
+	if e := m.load(key); e != nil {
+		if val, ok := get(e); ok {
+			m.mu.Unlock()
+			return val, nil
+		}
+	}
+	epoch := m.epoch
+	m.mu.Unlock()
+
+	val, err := read()
+	if err != nil {
+		return val, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.store(key, epoch); e != nil {
+		put(e, val)
+	}
+	return val, nil
+}
+
+// cachedStat is Stat on the wrapped filesystem, served from the metadata
+// cache if there is one. The caller must hold the filesystem lock.
+func (c *core) cachedStat(name string) (fs.FileInfo, error) {
+	m := c.meta
+	if m == nil || !m.stats && !m.misses {
+		return c.base.Stat(name)
+	}
+	key := c.abs(name)
+	if !c.direct(key, true) {
+		return c.base.Stat(name)
+	}
+	if err := m.missed(key); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	epoch := m.current()
+	var info fs.FileInfo
+	var err error
+	if m.stats {
+		info, err = cached(c, key,
+			func(e *metaEntry) (fs.FileInfo, bool) { return e.stat, e.stat != nil },
+			func() (fs.FileInfo, error) { return c.statCopy(name, c.base.Stat) },
+			func(e *metaEntry, info fs.FileInfo) { e.stat = info })
+	} else {
+		info, err = c.base.Stat(name)
+	}
+	if err != nil {
+		m.miss(key, epoch, err)
+	}
+	return info, err
+}
+
+// cachedLstat is Lstat on the wrapped filesystem, or Stat if it does not
+// support symbolic links, served from the metadata cache if there is one.
+// The caller must hold the filesystem lock.
+func (c *core) cachedLstat(name string) (fs.FileInfo, error) {
+	if c.meta == nil || !c.meta.stats {
+		return c.lstat(name)
+	}
+	key := c.abs(name)
+	if !c.direct(key, false) {
+		return c.lstat(name)
+	}
+	return c.lstatKey(key)
+}
+
+// lstatKey is cachedLstat for a key whose ancestors are not symbolic links.
+func (c *core) lstatKey(key string) (fs.FileInfo, error) {
+	return cached(c, key,
+		func(e *metaEntry) (fs.FileInfo, bool) { return e.lstat, e.lstat != nil },
+		func() (fs.FileInfo, error) { return c.lstat(key) },
+		func(e *metaEntry, info fs.FileInfo) { e.lstat = info })
+}
+
+// cachedReadDir is ReadDir on the wrapped filesystem, served from the
+// metadata cache if there is one. The caller must hold the filesystem lock.
+func (c *core) cachedReadDir(name string) ([]fs.DirEntry, error) {
+	if c.meta == nil || !c.meta.stats {
+		return c.base.ReadDir(name)
+	}
+	key := c.abs(name)
+	if !c.direct(key, true) {
+		return c.base.ReadDir(name)
+	}
+	entries, err := cached(c, key,
+		func(e *metaEntry) ([]fs.DirEntry, bool) { return e.dir, e.listed },
+		func() ([]fs.DirEntry, error) {
+			entries, err := c.base.ReadDir(name)
+			return cloneEntries(entries), err
+		},
+		func(e *metaEntry, entries []fs.DirEntry) { e.dir, e.listed = entries, true })
+	if err != nil {
+		return nil, err
+	}
+	return append([]fs.DirEntry(nil), entries...), nil
+}
+
+// cachedReadlink is Readlink on the wrapped filesystem, served from the
+// metadata cache if there is one. The caller must hold the filesystem lock.
+func (c *core) cachedReadlink(name string) (string, error) {
+	sl := c.base.(absfs.SymLinker)
+	if c.meta == nil || !c.meta.stats {
+		return sl.Readlink(name)
+	}
+	key := c.abs(name)
+	if !c.direct(key, false) {
+		return sl.Readlink(name)
+	}
+	return cached(c, key,
+		func(e *metaEntry) (string, bool) { return e.link, e.linked },
+		func() (string, error) { return sl.Readlink(name) },
+		func(e *metaEntry, link string) { e.link, e.linked = link, true })
+}
+
+// statCopy returns a copy of the FileInfo returned by stat for name.
+func (c *core) statCopy(name string, stat func(string) (fs.FileInfo, error)) (fs.FileInfo, error) {
+	info, err := stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotInfo(info), nil
+}
+
+// direct reports whether key names the same file as its lexical path, that
+// is whether none of its ancestors is a symbolic link, nor key itself if
+// follow is set. Only such keys are cached, as mutations are matched to
+// cached entries by key. The caller must hold the filesystem lock.
+func (c *core) direct(key string, follow bool) bool {
+	if _, ok := c.base.(absfs.SymLinker); !ok {
+		return true
+	}
+	var dirs []string
+	for dir := key; dir != "/"; dir = path.Dir(dir) {
+		if dir != key || follow {
+			dirs = append(dirs, dir)
+		}
+	}
+	m := c.meta
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if m.missed(dirs[i]) != nil {
+			return true
+		}
+		epoch := m.current()
+		info, err := c.lstatKey(dirs[i])
+		if err != nil {
+			m.miss(dirs[i], epoch, err)
+			return true
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidate drops the cached results for keys, the trees beneath them if
+// tree is set, and their parent directories, as well as the not-exist
+// results for their ancestors, which creating keys may create. If a key may
+// name another file through a symbolic link, it drops all cached results,
+// including the contents in the content cache, whose generations only
+// follow the paths mutations name. The caller must hold the filesystem lock.
+func (c *core) invalidate(keys []string, tree bool) {
+	if c.meta == nil {
+		return
+	}
+	all := false
+	for _, key := range keys {
+		if !c.direct(key, true) {
+			all = true
+		}
+	}
+	if all && c.content != nil {
+		c.content.reset()
+	}
+	m := c.meta
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.epoch++
+	if all {
+		m.entries = nil
+		return
+	}
+	for _, key := range keys {
+		delete(m.entries, key)
+		delete(m.entries, path.Dir(key))
+		for dir := path.Dir(key); dir != "/"; {
+			dir = path.Dir(dir)
+			if e := m.entries[dir]; e != nil {
+				e.missing = nil
+			}
+		}
+		if !tree {
+			continue
+		}
+		for k := range m.entries {
+			if within(k, key) {
+				delete(m.entries, k)
+			}
+		}
+	}
+}
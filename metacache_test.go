@@ -0,0 +1,270 @@
+package lockfs
+
+import (
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// countingFS counts the metadata calls made to the filesystem it wraps.
+type countingFS struct {
+	absfs.SymlinkFileSystem
+	calls atomic.Int32
+}
+
+func (c *countingFS) Stat(name string) (os.FileInfo, error) {
+	c.calls.Add(1)
+	return c.SymlinkFileSystem.Stat(name)
+}
+
+func (c *countingFS) Lstat(name string) (os.FileInfo, error) {
+	c.calls.Add(1)
+	return c.SymlinkFileSystem.Lstat(name)
+}
+
+func (c *countingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	c.calls.Add(1)
+	return c.SymlinkFileSystem.ReadDir(name)
+}
+
+// newCountingFS returns a wrapper with a metadata cache around a counting
+// memfs holding /dir/file.txt and a /link symbolic link to /dir.
+func newCountingFS(t *testing.T) (*SymlinkFileSystem, *countingFS) {
+	t.Helper()
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingFS{SymlinkFileSystem: mfs}
+	fsys, err := NewSymlinkFS(counting, WithMetadataCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileAtomic("/dir/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Symlink("/dir", "/link"); err != nil {
+		t.Fatal(err)
+	}
+	return fsys, counting
+}
+
+// statSize returns the size of name, failing the test on error.
+func statSize(t *testing.T, fsys *SymlinkFileSystem, name string) int64 {
+	t.Helper()
+	info, err := fsys.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// TestMetadataCacheHits tests that repeated metadata calls are served from
+// the cache.
+func TestMetadataCacheHits(t *testing.T) {
+	fsys, counting := newCountingFS(t)
+	statSize(t, fsys, "/dir/file.txt")
+	fsys.ReadDir("/dir")
+	fsys.Lstat("/link")
+	fsys.Readlink("/link")
+
+	before := counting.calls.Load()
+	for i := 0; i < 10; i++ {
+		statSize(t, fsys, "/dir/file.txt")
+		if _, err := fsys.ReadDir("/dir"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fsys.Lstat("/link"); err != nil {
+			t.Fatal(err)
+		}
+		if target, err := fsys.Readlink("/link"); err != nil || target != "/dir" {
+			t.Fatalf("Readlink = %q, %v, want /dir", target, err)
+		}
+	}
+	if calls := counting.calls.Load() - before; calls != 0 {
+		t.Errorf("cached calls reached the wrapped filesystem %d times", calls)
+	}
+}
+
+// TestMetadataCacheInvalidation tests that mutations through the wrapper
+// and its files drop the cached results they affect, and that paths
+// reached through symbolic links stay current.
+func TestMetadataCacheInvalidation(t *testing.T) {
+	fsys, _ := newCountingFS(t)
+	if size := statSize(t, fsys, "/dir/file.txt"); size != 5 {
+		t.Fatalf("size = %d, want 5", size)
+	}
+
+	f, err := fsys.OpenFile("/dir/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" world"))
+	if size := statSize(t, fsys, "/dir/file.txt"); size != 11 {
+		t.Errorf("size after Write = %d, want 11", size)
+	}
+	f.Truncate(2)
+	if size := statSize(t, fsys, "/dir/file.txt"); size != 2 {
+		t.Errorf("size after Truncate = %d, want 2", size)
+	}
+	f.Close()
+
+	entries, err := fsys.ReadDir("/dir")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ReadDir = %v, %v", entries, err)
+	}
+	if err := fsys.Mkdir("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := fsys.ReadDir("/dir"); len(entries) != 2 {
+		t.Errorf("ReadDir after Mkdir has %d entries, want 2", len(entries))
+	}
+
+	if err := fsys.Symlink("/dir/file.txt", "/flink"); err != nil {
+		t.Fatal(err)
+	}
+	statSize(t, fsys, "/flink")
+	if err := fsys.Truncate("/dir/file.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	if size := statSize(t, fsys, "/flink"); size != 0 {
+		t.Errorf("size through link after Truncate = %d, want 0", size)
+	}
+
+	if err := fsys.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/dir/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat after Rename error = %v, want not exist", err)
+	}
+	if size := statSize(t, fsys, "/moved/file.txt"); size != 0 {
+		t.Errorf("size after Rename = %d, want 0", size)
+	}
+}
+
+func (c *countingFS) Open(name string) (absfs.File, error) {
+	c.calls.Add(1)
+	return c.SymlinkFileSystem.Open(name)
+}
+
+func (c *countingFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	c.calls.Add(1)
+	return c.SymlinkFileSystem.OpenFile(name, flag, perm)
+}
+
+// TestNegativeCache tests that not-exist results of Stat and Open are served
+// from the cache until a mutation through the wrapper creates the path.
+func TestNegativeCache(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingFS{SymlinkFileSystem: mfs}
+	fsys, err := NewSymlinkFS(counting, WithNegativeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := func() {
+		t.Helper()
+		if _, err := fsys.Stat("/mod/a/index.js"); !os.IsNotExist(err) {
+			t.Fatalf("Stat error = %v, want not exist", err)
+		}
+		if _, err := fsys.Open("/mod/a/index.js"); !os.IsNotExist(err) {
+			t.Fatalf("Open error = %v, want not exist", err)
+		}
+	}
+	probe()
+	before := counting.calls.Load()
+	for i := 0; i < 10; i++ {
+		probe()
+	}
+	if calls := counting.calls.Load() - before; calls != 0 {
+		t.Errorf("cached misses reached the wrapped filesystem %d times", calls)
+	}
+
+	if err := fsys.MkdirAll("/mod/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	probe()
+	f, err := fsys.Create("/mod/a/index.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := fsys.Stat("/mod/a/index.js"); err != nil {
+		t.Errorf("Stat after Create error = %v", err)
+	}
+
+	if _, err := fsys.Stat("/mod/b"); !os.IsNotExist(err) {
+		t.Fatalf("Stat error = %v, want not exist", err)
+	}
+	if err := fsys.MkdirAll("/mod/b/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/mod/b"); err != nil {
+		t.Errorf("Stat after MkdirAll of a descendant error = %v", err)
+	}
+
+	if _, err := fsys.Stat("/mod/c/x"); !os.IsNotExist(err) {
+		t.Fatalf("Stat error = %v, want not exist", err)
+	}
+	if err := fsys.Rename("/mod/b", "/mod/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Symlink("/mod/a/index.js", "/mod/c/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/mod/c/x"); err != nil {
+		t.Errorf("Stat after Symlink error = %v", err)
+	}
+}
+
+// partialRenameFS renames /old, but reports an error, as a rename that
+// fails midway may.
+type partialRenameFS struct {
+	absfs.SymlinkFileSystem
+}
+
+func (fs *partialRenameFS) Rename(oldpath, newpath string) error {
+	if err := fs.SymlinkFileSystem.Rename(oldpath, newpath); err != nil || oldpath != "/old" {
+		return err
+	}
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrPermission}
+}
+
+// TestMetadataCacheFailedRename tests that a failed Rename drops the cached
+// results for both paths, as it may have made partial changes.
+func TestMetadataCacheFailedRename(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewSymlinkFS(&partialRenameFS{mfs}, WithMetadataCache(), WithNegativeCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileAtomic("/old", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	statSize(t, fsys, "/old")
+	if _, err := fsys.Stat("/new"); !os.IsNotExist(err) {
+		t.Fatalf("Stat(/new) error = %v, want not exist", err)
+	}
+
+	if err := fsys.Rename("/old", "/new"); err == nil {
+		t.Fatal("expected Rename to fail")
+	}
+	if _, err := fsys.Stat("/old"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/old) after failed Rename error = %v, want not exist", err)
+	}
+	if size := statSize(t, fsys, "/new"); size != 4 {
+		t.Errorf("size of /new after failed Rename = %d, want 4", size)
+	}
+}
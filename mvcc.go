@@ -0,0 +1,160 @@
+package lockfs
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sync"
+)
+
+// defaultMVCCSize is the number of bytes of results versions keeps unless
+// WithMVCCSize is used.
+const defaultMVCCSize = 16 << 20
+
+// versionOverhead is the estimated size of a result kept in versions, or of
+// a directory entry in one, besides the names and data it holds.
+const versionOverhead = 64
+
+// versions holds the results of the reads made in MVCC mode, which are the
+// last committed versions of the paths read while no mutation has been made
+// since. Only results read at the current generation are kept, up to max
+// bytes; results read once the limit is reached are not kept.
+type versions struct {
+	mu   sync.Mutex
+	gen  uint64
+	m    map[versionKey]version
+	size int64
+	max  int64
+}
+
+// versionKey identifies a read kept in versions.
+type versionKey struct {
+	op  string
+	key string
+}
+
+// version is a result kept in versions, with its estimated size.
+type version struct {
+	val  any
+	size int64
+}
+
+// get returns the result of operation op on key if it was read at
+// generation gen.
+func (v *versions) get(op, key string, gen uint64) (any, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.gen != gen {
+		return nil, false
+	}
+	ver, ok := v.m[versionKey{op, key}]
+	return ver.val, ok
+}
+
+// put records val as the result of operation op on key read at generation
+// gen, dropping the results read at older generations, unless that would
+// exceed the size limit.
+func (v *versions) put(op, key string, gen uint64, val any) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	switch {
+	case gen < v.gen:
+		return
+	case gen > v.gen || v.m == nil:
+		v.gen = gen
+		v.m = make(map[versionKey]version)
+		v.size = 0
+	}
+	k := versionKey{op, key}
+	size := versionSize(val)
+	if v.size-v.m[k].size+size > v.max {
+		return
+	}
+	v.size += size - v.m[k].size
+	v.m[k] = version{val, size}
+}
+
+// reset drops all results.
+func (v *versions) reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.m = nil
+	v.size = 0
+}
+
+// versionSize estimates the memory held by val, a result kept in versions.
+func versionSize(val any) int64 {
+	size := int64(versionOverhead)
+	switch val := val.(type) {
+	case []byte:
+		size += int64(len(val))
+	case []fs.DirEntry:
+		for _, e := range val {
+			size += versionOverhead + int64(len(e.Name()))
+		}
+	}
+	return size
+}
+
+// readCommitted performs read operation op on name under the filesystem read
+// lock. In MVCC mode, if the lock is held by a mutation in progress, it
+// returns the result of the same read made since the last mutation was
+// committed instead of waiting, if there is one. clone copies results so
+// callers do not share them.
+func readCommitted[T any](c *core, ctx context.Context, op, name string, read func(string) (T, error), clone func(T) T) (T, error) {
+	var zero T
+	if !c.mvcc || !path.IsAbs(name) {
+		if err := c.acquire(ctx, op, shared, name); err != nil {
+			return zero, err
+		}
+		defer c.release(shared)
+		return read(name)
+	}
+
+	key := path.Clean(name)
+	if c.m.TryRLock() {
+		c.m.RUnlock()
+	} else if !c.advisory.active() {
+		if val, ok := c.versions.get(op, key, c.gens.current()); ok {
+			return clone(val.(T)), nil
+		}
+	}
+	if err := c.acquire(ctx, op, shared, name); err != nil {
+		return zero, err
+	}
+	defer c.release(shared)
+	gen := c.gens.current()
+	val, err := read(name)
+	if err != nil {
+		return val, err
+	}
+	// The result read is the caller's, so only the kept one is a copy.
+	c.versions.put(op, key, gen, clone(val))
+	return val, nil
+}
+
+func cloneBytes(b []byte) []byte { return append([]byte(nil), b...) }
+
+func cloneEntries(entries []fs.DirEntry) []fs.DirEntry {
+	clone := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		clone[i] = e
+		if _, ok := e.(fileInfoEntry); ok {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			clone[i] = fileInfoEntry{snapshotInfo(info)}
+		}
+	}
+	return clone
+}
+
+// fileInfoEntry is a directory entry holding a copy of the FileInfo of the
+// entry it was made from.
+type fileInfoEntry struct {
+	fs.FileInfo
+}
+
+func (e fileInfoEntry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e fileInfoEntry) Info() (fs.FileInfo, error) { return e.FileInfo, nil }
+func (e fileInfoEntry) String() string             { return fs.FormatDirEntry(e) }
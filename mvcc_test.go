@@ -0,0 +1,105 @@
+package lockfs
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestMVCCReadsDuringMutation tests that in MVCC mode, reads made while a
+// mutation holds the filesystem lock return the last committed version, and
+// reads without one wait.
+func TestMVCCReadsDuringMutation(t *testing.T) {
+	fsys := newShareFS(t, WithMVCC())
+	if err := fsys.WriteFileAtomic("/dir/file.txt", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.ReadFile("/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.ReadDir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stand in for a mutation in progress.
+	fsys.m.Lock()
+	data, err := fsys.ReadFile("/dir/file.txt")
+	if err != nil || string(data) != "v1" {
+		t.Errorf("ReadFile = %q, %v, want %q", data, err, "v1")
+	}
+	data[0] = 'x'
+	if data, _ := fsys.ReadFile("/dir/file.txt"); string(data) != "v1" {
+		t.Errorf("ReadFile after modifying result = %q, want %q", data, "v1")
+	}
+	entries, err := fsys.ReadDir("/dir")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "file.txt" {
+		t.Errorf("ReadDir = %v, %v, want [file.txt]", entries, err)
+	}
+	stat := waitAsync(func() error {
+		_, err := fsys.Stat("/dir/file.txt")
+		return err
+	})
+	expectPending(t, stat)
+	fsys.m.Unlock()
+	expectDone(t, stat)
+
+	if err := fsys.WriteFileAtomic("/dir/file.txt", []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fsys.m.Lock()
+	read := waitAsync(func() error {
+		data, err := fsys.ReadFile("/dir/file.txt")
+		if err == nil && string(data) != "v2" {
+			err = errors.New("read " + string(data))
+		}
+		return err
+	})
+	expectPending(t, read)
+	fsys.m.Unlock()
+	expectDone(t, read)
+}
+
+// TestMVCCOff tests that without MVCC mode reads wait for mutations in
+// progress.
+func TestMVCCOff(t *testing.T) {
+	fsys := newShareFS(t)
+	if _, err := fsys.ReadFile("/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	fsys.m.Lock()
+	read := waitAsync(func() error {
+		_, err := fsys.ReadFile("/dir/file.txt")
+		return err
+	})
+	expectPending(t, read)
+	fsys.m.Unlock()
+	expectDone(t, read)
+}
+
+// TestMVCCSize tests that results beyond the WithMVCCSize limit are not
+// kept, so reads of them wait for mutations in progress.
+func TestMVCCSize(t *testing.T) {
+	fsys := newShareFS(t, WithMVCC(), WithMVCCSize(1024))
+	if err := fsys.WriteFileAtomic("/dir/small.txt", []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileAtomic("/dir/large.txt", make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/dir/small.txt", "/dir/large.txt"} {
+		if _, err := fsys.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fsys.m.Lock()
+	if data, err := fsys.ReadFile("/dir/small.txt"); err != nil || string(data) != "small" {
+		t.Errorf("ReadFile = %q, %v, want %q", data, err, "small")
+	}
+	read := waitAsync(func() error {
+		_, err := fsys.ReadFile("/dir/large.txt")
+		return err
+	})
+	expectPending(t, read)
+	fsys.m.Unlock()
+	expectDone(t, read)
+}
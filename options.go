@@ -0,0 +1,143 @@
+package lockfs
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Option configures a wrapper created by NewFiler, NewFS or NewSymlinkFS.
+type Option func(*core)
+
+// WithShareModes enables Windows-style sharing modes: every open is checked
+// against the share modes of the files already open at the same path, and
+// fails with ErrSharingViolation on conflict. Files opened with Open, Create
+// or OpenFile use the share mode def; OpenFileShare selects one per file.
+func WithShareModes(def ShareMode) Option {
+	return func(c *core) {
+		c.shareModes = true
+		c.defaultShare = def
+	}
+}
+
+// WithBusyMode selects how Remove, RemoveAll, Rename and Truncate treat paths
+// that files are open at. See BusyMode.
+func WithBusyMode(mode BusyMode) Option {
+	return func(c *core) {
+		c.busyMode = mode
+	}
+}
+
+// WithDrainFiles makes Close wait for open files to be closed, until its
+// context is done, before closing the remaining ones itself.
+func WithDrainFiles() Option {
+	return func(c *core) {
+		c.drainFiles = true
+	}
+}
+
+// WithFreezeFailFast makes operations that would modify a frozen wrapper fail
+// with ErrFrozen rather than wait for it to thaw.
+func WithFreezeFailFast() Option {
+	return func(c *core) {
+		c.freezeFailFast = true
+	}
+}
+
+// WithMVCC makes ReadFile, Stat and ReadDir calls with absolute names
+// return the last committed version of the path, rather than wait, while a
+// mutation holds the filesystem lock. The last committed version is the
+// result of the same call made since the most recent mutation through the
+// wrapper completed; calls for which there is none wait as usual, as do all
+// calls while an advisory lock is held.
+//
+// This costs memory: a copy of every result read since the most recent
+// mutation is kept, up to the limit set by WithMVCCSize, 16 MiB by default.
+// Once the limit is reached, further results are not kept, and calls for
+// them wait as usual.
+func WithMVCC() Option {
+	return func(c *core) {
+		c.mvcc = true
+	}
+}
+
+// WithMVCCSize sets the number of bytes of results WithMVCC keeps as the
+// last committed versions of paths. The default is 16 MiB.
+func WithMVCCSize(max int64) Option {
+	return func(c *core) {
+		c.versions.max = max
+	}
+}
+
+// WithMetadataCache caches the results of Stat, Lstat, ReadDir and Readlink
+// calls. Cached results are dropped by the mutations made through the
+// wrapper, including writes to its files, so the wrapped filesystem must not
+// be mutated by others. Paths reached through symbolic links are not cached.
+func WithMetadataCache() Option {
+	return func(c *core) {
+		c.metaCache().stats = true
+	}
+}
+
+// WithNegativeCache caches the paths that Stat, and Open and OpenFile
+// without os.O_CREATE, find not to exist, and fails later calls for them
+// without calling the wrapped filesystem. Cached results are dropped by the
+// mutations made through the wrapper that may create the paths, so the
+// wrapped filesystem must not be mutated by others.
+func WithNegativeCache() Option {
+	return func(c *core) {
+		c.metaCache().misses = true
+	}
+}
+
+// WithContentCache caches the contents of regular files read with ReadFile
+// or opened read-only, up to max bytes, evicting the least recently used
+// files. Files are cached by path and generation, so the mutations made
+// through the wrapper, including writes to its files, make their cached
+// contents stale; the wrapped filesystem must not be mutated by others.
+// Paths reached through symbolic links are not cached.
+func WithContentCache(max int64) Option {
+	return func(c *core) {
+		c.metaCache()
+		c.content = &contentCache{max: max}
+	}
+}
+
+// WithGroupSync makes concurrent Sync calls on a file share one Sync of the
+// underlying file. The first call waits for window to collect others before
+// syncing on behalf of all of them, and they all return its result. Calls
+// made while it syncs are served by the next underlying Sync.
+func WithGroupSync(window time.Duration) Option {
+	return func(c *core) {
+		c.groupSync = true
+		c.syncWindow = window
+	}
+}
+
+// WithJournalSize sets the number of changes the journal read by
+// ChangesSince retains. The default is 1024.
+func WithJournalSize(n int) Option {
+	return func(c *core) {
+		c.gens.log.size = n
+	}
+}
+
+// WithAudit records every mutating call made through the wrapper, and the
+// files opened through it, as a JSON-encoded AuditRecord per line written to
+// w. Writes to w are serialized. Use WithPrincipal to identify who makes the
+// calls.
+func WithAudit(w io.Writer) Option {
+	return func(c *core) {
+		c.auditLog = &auditLog{enc: json.NewEncoder(w)}
+	}
+}
+
+// WithWAL makes Transact record the intent of each transaction in a
+// write-ahead log at name in the wrapped filesystem before applying it. If a
+// crash interrupts a transaction, the wrapper created next with the same log
+// completes it if it was committed, and rolls it back otherwise.
+func WithWAL(name string) Option {
+	return func(c *core) {
+		c.wal = name
+	}
+}
@@ -0,0 +1,40 @@
+package lockfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// SetReadOnly switches the wrapper into or out of read-only mode. While it is
+// read-only, operations that would modify the filesystem, including opening
+// files for writing and Write, WriteAt, WriteString and Truncate on files that
+// are already open, fail with syscall.EROFS. SetReadOnly waits for the
+// mutations in progress to complete.
+func (c *core) SetReadOnly(readOnly bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.readOnly = readOnly
+}
+
+// ReadOnly reports whether the wrapper is in read-only mode.
+func (c *core) ReadOnly() bool {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.readOnly
+}
+
+// writable returns an error if operation op of access a on names would
+// modify a read-only wrapper. The caller must hold the filesystem lock.
+func (c *core) writable(op string, a access, names ...string) error {
+	if !c.readOnly || a&mutating == 0 {
+		return nil
+	}
+	if len(names) == 2 {
+		return &os.LinkError{Op: op, Old: names[0], New: names[1], Err: syscall.EROFS}
+	}
+	var name string
+	if len(names) > 0 {
+		name = names[0]
+	}
+	return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
@@ -0,0 +1,66 @@
+package lockfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// TestReadOnly tests that mutations fail with EROFS while the wrapper is
+// read-only, and that reads are not affected.
+func TestReadOnly(t *testing.T) {
+	fsys := newShareFS(t)
+
+	f, err := fsys.OpenFile("/dir/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fsys.SetReadOnly(true)
+	if !fsys.ReadOnly() {
+		t.Fatal("expected ReadOnly to report true")
+	}
+
+	_, openErr := fsys.OpenFile("/dir/file.txt", os.O_WRONLY, 0)
+	_, createErr := fsys.Create("/new.txt")
+	_, writeErr := f.Write([]byte("data"))
+	for name, err := range map[string]error{
+		"OpenFile":      openErr,
+		"Create":        createErr,
+		"Mkdir":         fsys.Mkdir("/new", 0755),
+		"Remove":        fsys.Remove("/dir/file.txt"),
+		"RemoveAll":     fsys.RemoveAll("/dir"),
+		"Rename":        fsys.Rename("/dir", "/moved"),
+		"Chmod":         fsys.Chmod("/dir", 0700),
+		"Truncate":      fsys.Truncate("/dir/file.txt", 0),
+		"Write":         writeErr,
+		"File.Truncate": f.Truncate(0),
+	} {
+		if !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%s: expected EROFS, got %v", name, err)
+		}
+	}
+	var pathErr *os.PathError
+	if err := fsys.Remove("/dir/file.txt"); !errors.As(err, &pathErr) || pathErr.Op != "remove" {
+		t.Errorf("expected a remove *os.PathError, got %v", err)
+	}
+
+	r, err := fsys.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := fsys.Stat("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.SetReadOnly(false)
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir("/new", 0755); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,575 @@
+package lockfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrReleased is returned by operations on a Snapshot that has been
+// released.
+var ErrReleased = errors.New("snapshot released")
+
+// Snapshot is a read-only view of the filesystem of a wrapper as it was when
+// the snapshot was taken. Paths are copied into the snapshot lazily, when
+// they are first mutated through the wrapper afterwards, so unchanged files
+// are read from the wrapped filesystem and taking a snapshot is cheap.
+// Mutations made directly on the wrapped filesystem are not seen by the
+// wrapper, and show through the snapshot.
+//
+// Snapshot implements absfs.SymlinkFileSystem; all mutating methods fail
+// with syscall.EROFS. Release the snapshot once done with it, so the wrapper
+// stops copying paths into it.
+type Snapshot struct {
+	c *core
+
+	mu       sync.Mutex
+	saved    map[string]*savedEntry
+	cwd      string
+	released bool
+}
+
+var _ absfs.SymlinkFileSystem = (*Snapshot)(nil)
+
+// savedEntry is the state of a path in a snapshot.
+type savedEntry struct {
+	info    fs.FileInfo   // nil if the path did not exist
+	data    []byte        // contents of regular files
+	link    string        // target of symbolic links
+	entries []fs.FileInfo // entries of directories, sorted by name
+	err     error         // error reading data, link or entries
+}
+
+// snapshots holds the live snapshots of a wrapper.
+type snapshots struct {
+	mu    sync.Mutex
+	list  []*Snapshot
+	count atomic.Int32
+}
+
+// Snapshot takes a snapshot of the filesystem. It waits for the mutations in
+// progress to complete.
+func (c *core) Snapshot() (*Snapshot, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := c.ensureOpen(); err != nil {
+		return nil, err
+	}
+	s := &Snapshot{c: c, saved: make(map[string]*savedEntry), cwd: "/"}
+	c.snapshots.mu.Lock()
+	c.snapshots.list = append(c.snapshots.list, s)
+	c.snapshots.count.Add(1)
+	c.snapshots.mu.Unlock()
+	return s, nil
+}
+
+// Release releases the snapshot and the copies it holds. Operations on it
+// fail with ErrReleased afterwards.
+func (s *Snapshot) Release() {
+	ss := &s.c.snapshots
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i, live := range ss.list {
+		if live == s {
+			ss.list = append(ss.list[:i], ss.list[i+1:]...)
+			ss.count.Add(-1)
+		}
+	}
+	s.mu.Lock()
+	s.released = true
+	s.saved = nil
+	s.mu.Unlock()
+}
+
+// preserve copies the state of keys, and of the trees beneath them if tree
+// is set, into the live snapshots before they are mutated. Keys reached
+// through symbolic links are preserved at the paths they resolve to as well,
+// since mutations through the links change the files there. The caller must
+// hold the filesystem lock.
+func (c *core) preserve(keys []string, tree bool) {
+	if c.snapshots.count.Load() == 0 {
+		return
+	}
+	all := keys
+	for _, key := range keys {
+		if resolved := c.resolve(key); resolved != key {
+			all = append(all[:len(all):len(all)], resolved)
+		}
+	}
+	c.snapshots.mu.Lock()
+	defer c.snapshots.mu.Unlock()
+	for _, s := range c.snapshots.list {
+		s.mu.Lock()
+		for _, key := range all {
+			s.preserve(key, tree)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// resolve returns the path key names once the symbolic links among its
+// ancestors and key itself are followed. Components that do not exist are
+// kept as they are. If a link cannot be read, or there are too many of them,
+// key is returned. The caller must hold the filesystem lock.
+func (c *core) resolve(key string) string {
+	sl, ok := c.base.(absfs.SymLinker)
+	if !ok {
+		return key
+	}
+	resolved, rest := "/", strings.Split(key, "/")
+	for hops := 0; len(rest) > 0; {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" {
+			continue
+		}
+		next := path.Join(resolved, name)
+		info, err := c.lstat(next)
+		if err != nil {
+			return path.Join(append([]string{next}, rest...)...)
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if hops++; hops > 40 {
+			return key
+		}
+		link, err := sl.Readlink(next)
+		if err != nil {
+			return key
+		}
+		if !path.IsAbs(link) {
+			link = path.Join(resolved, link)
+		}
+		resolved, rest = "/", append(strings.Split(path.Clean(link), "/"), rest...)
+	}
+	return resolved
+}
+
+// preserve saves key, the tree beneath it if tree is set, and the listings
+// of the directories the mutation of key may change: its parent, and the
+// ancestors that MkdirAll may create. The caller must hold s.mu.
+func (s *Snapshot) preserve(key string, tree bool) {
+	e := s.save(key)
+	if tree {
+		s.saveTree(key, e)
+	}
+	for dir := key; dir != "/"; {
+		dir = path.Dir(dir)
+		if s.save(dir).info != nil {
+			break
+		}
+	}
+}
+
+// save saves the current state of key unless it is saved already.
+func (s *Snapshot) save(key string) *savedEntry {
+	e := s.saved[key]
+	if e == nil {
+		e = s.c.capture(key)
+		s.saved[key] = e
+	}
+	return e
+}
+
+// saveTree saves the tree beneath key, whose entry is e.
+func (s *Snapshot) saveTree(key string, e *savedEntry) {
+	for _, info := range e.entries {
+		child := path.Join(key, info.Name())
+		s.saveTree(child, s.save(child))
+	}
+}
+
+// capture reads the current state of key from the wrapped filesystem. The
+// caller must hold the filesystem lock.
+func (c *core) capture(key string) *savedEntry {
+	info, err := c.lstat(key)
+	if err != nil {
+		return &savedEntry{}
+	}
+	e := &savedEntry{info: info}
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		e.data, e.err = c.base.ReadFile(key)
+	case mode&fs.ModeSymlink != 0:
+		if sl, ok := c.base.(absfs.SymLinker); ok {
+			e.link, e.err = sl.Readlink(key)
+		}
+	case mode.IsDir():
+		var entries []fs.DirEntry
+		if entries, e.err = c.base.ReadDir(key); e.err != nil {
+			break
+		}
+		for _, entry := range entries {
+			info, err := c.lstat(path.Join(key, entry.Name()))
+			if err != nil {
+				e.err = err
+				break
+			}
+			e.entries = append(e.entries, info)
+		}
+		sort.Slice(e.entries, func(i, j int) bool { return e.entries[i].Name() < e.entries[j].Name() })
+	}
+	return e
+}
+
+// entry returns the state of key in the snapshot. The caller must hold the
+// filesystem read lock and s.mu.
+func (s *Snapshot) entry(key string) *savedEntry {
+	if e := s.saved[key]; e != nil {
+		return e
+	}
+	// The nearest saved ancestor, if any, decides whether key existed.
+	for dir := key; dir != "/"; {
+		child := path.Base(dir)
+		dir = path.Dir(dir)
+		e := s.saved[dir]
+		if e == nil {
+			continue
+		}
+		if e.info == nil || !e.info.IsDir() {
+			return &savedEntry{}
+		}
+		i := sort.Search(len(e.entries), func(i int) bool { return e.entries[i].Name() >= child })
+		if i == len(e.entries) || e.entries[i].Name() != child {
+			return &savedEntry{}
+		}
+		break
+	}
+	return s.c.capture(key)
+}
+
+// get returns the state of name in the snapshot, following symbolic links
+// within the snapshot if follow is set.
+func (s *Snapshot) get(op, name string, follow bool) (*savedEntry, error) {
+	s.c.m.RLock()
+	defer s.c.m.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return nil, &os.PathError{Op: op, Path: name, Err: ErrReleased}
+	}
+	key := s.abs(name)
+	for hops := 0; ; hops++ {
+		e := s.entry(key)
+		switch {
+		case e.info == nil:
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		case e.err != nil:
+			return nil, &os.PathError{Op: op, Path: name, Err: e.err}
+		case !follow || e.info.Mode()&fs.ModeSymlink == 0:
+			return e, nil
+		case hops == 40:
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+		}
+		if path.IsAbs(e.link) {
+			key = path.Clean(e.link)
+		} else {
+			key = path.Join(path.Dir(key), e.link)
+		}
+	}
+}
+
+// abs returns the absolute form of name. The caller must hold s.mu.
+func (s *Snapshot) abs(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	return path.Join(s.cwd, name)
+}
+
+// Stat returns a FileInfo describing the named file in the snapshot.
+func (s *Snapshot) Stat(name string) (os.FileInfo, error) {
+	e, err := s.get("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+// Lstat is like Stat, but does not follow a symbolic link at name.
+func (s *Snapshot) Lstat(name string) (os.FileInfo, error) {
+	e, err := s.get("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+// Readlink returns the target of the symbolic link at name in the snapshot.
+func (s *Snapshot) Readlink(name string) (string, error) {
+	e, err := s.get("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.info.Mode()&fs.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+	}
+	return e.link, nil
+}
+
+// ReadFile returns the contents of the named file in the snapshot.
+func (s *Snapshot) ReadFile(name string) ([]byte, error) {
+	e, err := s.get("readfile", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.info.IsDir() {
+		return nil, &os.PathError{Op: "readfile", Path: name, Err: syscall.EISDIR}
+	}
+	return append([]byte(nil), e.data...), nil
+}
+
+// ReadDir returns the entries of the named directory in the snapshot,
+// sorted by name.
+func (s *Snapshot) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := s.get("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !e.info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	entries := make([]fs.DirEntry, len(e.entries))
+	for i, info := range e.entries {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+// Open opens the named file in the snapshot for reading.
+func (s *Snapshot) Open(name string) (absfs.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file in the snapshot. Opening it for writing
+// fails with syscall.EROFS.
+func (s *Snapshot) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if writes(flag) || flag&os.O_CREATE != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+	}
+	e, err := s.get("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotFile{name: name, entry: e, r: bytes.NewReader(e.data)}, nil
+}
+
+// Sub returns an fs.FS for the subtree of the snapshot rooted at dir.
+func (s *Snapshot) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(s, dir)
+}
+
+// Chdir changes the working directory of the snapshot, which relative names
+// are resolved against. It starts out as "/".
+func (s *Snapshot) Chdir(dir string) error {
+	info, err := s.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "chdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cwd = s.abs(dir)
+	return nil
+}
+
+// Getwd returns the working directory of the snapshot.
+func (s *Snapshot) Getwd() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cwd, nil
+}
+
+// TempDir returns the temporary directory of the wrapped filesystem, which
+// is read-only in the snapshot.
+func (s *Snapshot) TempDir() string {
+	if t, ok := s.c.base.(interface{ TempDir() string }); ok {
+		return t.TempDir()
+	}
+	return "/tmp"
+}
+
+func readOnly(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+// Create fails with syscall.EROFS.
+func (s *Snapshot) Create(name string) (absfs.File, error) { return nil, readOnly("open", name) }
+
+// Mkdir fails with syscall.EROFS.
+func (s *Snapshot) Mkdir(name string, perm os.FileMode) error { return readOnly("mkdir", name) }
+
+// MkdirAll fails with syscall.EROFS.
+func (s *Snapshot) MkdirAll(name string, perm os.FileMode) error { return readOnly("mkdir", name) }
+
+// Remove fails with syscall.EROFS.
+func (s *Snapshot) Remove(name string) error { return readOnly("remove", name) }
+
+// RemoveAll fails with syscall.EROFS.
+func (s *Snapshot) RemoveAll(name string) error { return readOnly("removeall", name) }
+
+// Rename fails with syscall.EROFS.
+func (s *Snapshot) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EROFS}
+}
+
+// Chmod fails with syscall.EROFS.
+func (s *Snapshot) Chmod(name string, mode os.FileMode) error { return readOnly("chmod", name) }
+
+// Chtimes fails with syscall.EROFS.
+func (s *Snapshot) Chtimes(name string, atime, mtime time.Time) error {
+	return readOnly("chtimes", name)
+}
+
+// Chown fails with syscall.EROFS.
+func (s *Snapshot) Chown(name string, uid, gid int) error { return readOnly("chown", name) }
+
+// Lchown fails with syscall.EROFS.
+func (s *Snapshot) Lchown(name string, uid, gid int) error { return readOnly("lchown", name) }
+
+// Truncate fails with syscall.EROFS.
+func (s *Snapshot) Truncate(name string, size int64) error { return readOnly("truncate", name) }
+
+// Symlink fails with syscall.EROFS.
+func (s *Snapshot) Symlink(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EROFS}
+}
+
+// snapshotFile is a file opened in a Snapshot. Its contents are read when it
+// is opened.
+type snapshotFile struct {
+	name  string
+	entry *savedEntry
+
+	mu     sync.Mutex
+	r      *bytes.Reader
+	dirPos int
+	closed bool
+}
+
+func (f *snapshotFile) Name() string { return f.name }
+
+func (f *snapshotFile) check(op string) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *snapshotFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if f.entry.info.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	return f.r.Read(p)
+}
+
+func (f *snapshotFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func (f *snapshotFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *snapshotFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return f.entry.info, nil
+}
+
+func (f *snapshotFile) Readdir(n int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("readdir"); err != nil {
+		return nil, err
+	}
+	if !f.entry.info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	rest := f.entry.entries[f.dirPos:]
+	if n <= 0 {
+		f.dirPos += len(rest)
+		return append([]os.FileInfo(nil), rest...), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	f.dirPos += n
+	return append([]os.FileInfo(nil), rest[:n]...), nil
+}
+
+func (f *snapshotFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (f *snapshotFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := f.Readdir(n)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, err
+}
+
+func (f *snapshotFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *snapshotFile) Sync() error { return nil }
+
+func (f *snapshotFile) Write(p []byte) (int, error) { return 0, readOnly("write", f.name) }
+
+func (f *snapshotFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+func (f *snapshotFile) WriteString(s string) (int, error) { return 0, readOnly("write", f.name) }
+
+func (f *snapshotFile) Truncate(size int64) error { return readOnly("truncate", f.name) }
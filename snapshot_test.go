@@ -0,0 +1,186 @@
+package lockfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// readString returns the contents of name in s, failing the test on error.
+func readString(t *testing.T, s *Snapshot, name string) string {
+	t.Helper()
+	data, err := s.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestSnapshotPreservesState tests that a snapshot keeps showing the state
+// at the time it was taken while the wrapper is mutated.
+func TestSnapshotPreservesState(t *testing.T) {
+	fsys := newExportFS(t)
+	snap, err := fsys.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	f, err := fsys.OpenFile("/data/sub/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(" world"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := fsys.Chmod("/data/sub/file.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.MkdirAll("/data/new/deep", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/data/sub", "/data/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("/data/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readString(t, snap, "/data/sub/file.txt"); got != "hello" {
+		t.Errorf("snapshot contents = %q, want %q", got, "hello")
+	}
+	if got := readString(t, snap, "/data/link"); got != "hello" {
+		t.Errorf("snapshot contents through link = %q, want %q", got, "hello")
+	}
+	info, err := snap.Stat("/data/sub/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || info.Size() != 5 {
+		t.Errorf("snapshot mode, size = %v, %d, want %v, 5", info.Mode().Perm(), info.Size(), os.FileMode(0640))
+	}
+	for _, name := range []string{"/data/moved", "/data/moved/file.txt", "/data/new", "/data/new/deep"} {
+		if _, err := snap.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("snapshot Stat(%s) error = %v, want os.ErrNotExist", name, err)
+		}
+	}
+	entries, err := snap.ReadDir("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 || names[0] != "link" || names[1] != "sub" {
+		t.Errorf("snapshot entries = %v, want [link sub]", names)
+	}
+
+	if got, err := fsys.ReadFile("/data/moved/file.txt"); err != nil || string(got) != "hello world" {
+		t.Errorf("live contents = %q, %v, want %q", got, err, "hello world")
+	}
+}
+
+// TestSnapshotSymlinkWrite tests that a write through a symbolic link
+// leaves the snapshot with the contents of the target from before it.
+func TestSnapshotSymlinkWrite(t *testing.T) {
+	fsys := newExportFS(t)
+	snap, err := fsys.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	f, err := fsys.OpenFile("/data/link", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, name := range []string{"/data/sub/file.txt", "/data/link"} {
+		if got := readString(t, snap, name); got != "hello" {
+			t.Errorf("snapshot contents of %s = %q, want %q", name, got, "hello")
+		}
+	}
+	if got, err := fsys.ReadFile("/data/sub/file.txt"); err != nil || string(got) != "hello world" {
+		t.Errorf("live contents = %q, %v, want %q", got, err, "hello world")
+	}
+}
+
+// TestSnapshotUnchangedAndReleased tests that paths left unchanged read
+// through to the wrapped filesystem, and that a released snapshot fails.
+func TestSnapshotUnchangedAndReleased(t *testing.T) {
+	fsys := newShareFS(t)
+	if err := fsys.WriteFileAtomic("/dir/file.txt", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := fsys.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.saved) != 0 {
+		t.Errorf("fresh snapshot holds %d copies", len(snap.saved))
+	}
+	if got := readString(t, snap, "/dir/file.txt"); got != "v1" {
+		t.Errorf("snapshot contents = %q, want %q", got, "v1")
+	}
+	if err := fsys.WriteFileAtomic("/dir/file.txt", []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, snap, "/dir/file.txt"); got != "v1" {
+		t.Errorf("snapshot contents = %q, want %q", got, "v1")
+	}
+
+	f, err := snap.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != "v1" {
+		t.Errorf("snapshot file contents = %q, %v, want %q", data, err, "v1")
+	}
+	f.Close()
+
+	snap.Release()
+	if err := fsys.WriteFileAtomic("/dir/file.txt", []byte("v3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.ReadFile("/dir/file.txt"); !errors.Is(err, ErrReleased) {
+		t.Errorf("ReadFile after Release error = %v, want ErrReleased", err)
+	}
+}
+
+// TestSnapshotReadOnly tests that mutations through a snapshot fail with
+// EROFS.
+func TestSnapshotReadOnly(t *testing.T) {
+	fsys := newShareFS(t)
+	snap, err := fsys.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	if _, err := snap.OpenFile("/dir/file.txt", os.O_RDWR, 0); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("OpenFile(O_RDWR) error = %v, want EROFS", err)
+	}
+	if err := snap.Remove("/dir/file.txt"); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Remove error = %v, want EROFS", err)
+	}
+	if err := snap.Rename("/dir/file.txt", "/dir/b"); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Rename error = %v, want EROFS", err)
+	}
+	f, err := snap.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("x")); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Write error = %v, want EROFS", err)
+	}
+}
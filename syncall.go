@@ -0,0 +1,51 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+)
+
+// SyncAll syncs every file open for writing through the wrapper, so the data
+// written to them reaches stable storage, and returns the errors syncing
+// them joined, as *os.PathError values naming the files. Files closed while
+// SyncAll runs are skipped. If ctx is done before all files are synced,
+// SyncAll stops and includes ctx.Err() in the result. Syncing a closed
+// wrapper returns ErrClosed.
+func (c *core) SyncAll(ctx context.Context) error {
+	c.m.RLock()
+	if err := c.ensureOpen(); err != nil {
+		c.m.RUnlock()
+		return err
+	}
+	// Keys are moved by renames, under the filesystem write lock.
+	var files []*File
+	for _, f := range c.handles.all() {
+		if writes(f.flag) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].key < files[j].key })
+	c.m.RUnlock()
+
+	var errs []error
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		err := f.syncContext(ctx)
+		var pe *os.PathError
+		switch {
+		case err == nil || errors.Is(err, os.ErrClosed):
+		case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+			return errors.Join(append(errs, err)...)
+		case errors.As(err, &pe):
+			errs = append(errs, err)
+		default:
+			errs = append(errs, &os.PathError{Op: "sync", Path: f.Name(), Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
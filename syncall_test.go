@@ -0,0 +1,157 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+var errSyncFailed = errors.New("sync failed")
+
+// failingSyncFS fails Sync for the files it opens whose names contain
+// "bad", and counts the other Sync calls.
+type failingSyncFS struct {
+	syncCountingFS
+}
+
+func (s *failingSyncFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := s.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(name, "bad") {
+		return &failingSyncFile{f}, nil
+	}
+	return &syncCountingFile{File: f, fs: &s.syncCountingFS}, nil
+}
+
+type failingSyncFile struct {
+	absfs.File
+}
+
+func (f *failingSyncFile) Sync() error { return errSyncFailed }
+
+// TestSyncAll tests that SyncAll syncs the files open for writing and
+// reports the ones it failed to sync.
+func TestSyncAll(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &failingSyncFS{syncCountingFS{FileSystem: mfs}}
+	fsys, err := NewFS(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, name := range []string{"/a", "/b", "/bad", "/ro"} {
+		f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+	}
+	ro, err := fsys.OpenFile("/ro", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	closed, err := fsys.OpenFile("/closed", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	err = fsys.SyncAll(ctx)
+	var pe *os.PathError
+	if !errors.Is(err, errSyncFailed) || !errors.As(err, &pe) || pe.Path != "/bad" {
+		t.Errorf("SyncAll error = %v, want sync error for /bad", err)
+	}
+	if syncs := base.syncs.Load(); syncs != 3 {
+		t.Errorf("SyncAll made %d syncs, want 3", syncs)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := fsys.SyncAll(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("SyncAll with canceled context error = %v, want context.Canceled", err)
+	}
+
+	if err := fsys.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.SyncAll(ctx); !errors.Is(err, ErrClosed) {
+		t.Errorf("SyncAll after Close error = %v, want ErrClosed", err)
+	}
+}
+
+// TestSyncAllFrozen tests that SyncAll on a frozen wrapper stops waiting
+// once its context is done.
+func TestSyncAllFrozen(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithGroupSync(time.Millisecond)}} {
+		fsys := newShareFS(t, opts...)
+		f, err := fsys.OpenFile("/dir/file.txt", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := fsys.Freeze(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		done := waitAsync(func() error { return fsys.SyncAll(ctx) })
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("SyncAll error = %v, want context.DeadlineExceeded", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("SyncAll did not return once its context was done")
+		}
+		cancel()
+		fsys.Thaw()
+	}
+}
+
+// TestSyncAllRename tests that SyncAll can run alongside renames of the
+// paths files are open at.
+func TestSyncAllRename(t *testing.T) {
+	fsys := newShareFS(t)
+	f, err := fsys.OpenFile("/dir/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g, err := fsys.OpenFile("/other.txt", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	done := waitAsync(func() error {
+		for i := 0; i < 50; i++ {
+			if err := fsys.SyncAll(context.Background()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for i := 0; i < 50; i++ {
+		from, to := "/dir", "/dir2"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		if err := fsys.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectDone(t, done)
+}
@@ -0,0 +1,494 @@
+package lockfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/absfs/absfs"
+)
+
+// TxOp is a step of a transaction applied by Transact.
+type TxOp struct {
+	Op      string `json:"op"` // "rename", "remove" or "writefile"
+	Path    string `json:"path"`
+	NewPath string `json:"new_path,omitempty"` // for "rename"
+	Temp    string `json:"temp,omitempty"`     // staged contents for "writefile"
+	Backup  string `json:"backup,omitempty"`   // what the step replaces or removes
+
+	data []byte
+	perm os.FileMode
+}
+
+// TxRename returns a step renaming oldpath to newpath.
+func TxRename(oldpath, newpath string) TxOp {
+	return TxOp{Op: "rename", Path: oldpath, NewPath: newpath}
+}
+
+// TxRemove returns a step removing name.
+func TxRemove(name string) TxOp {
+	return TxOp{Op: "remove", Path: name}
+}
+
+// TxWriteFile returns a step replacing the contents of name with data, like
+// WriteFileAtomic.
+func TxWriteFile(name string, data []byte, perm os.FileMode) TxOp {
+	return TxOp{Op: "writefile", Path: name, data: data, perm: perm}
+}
+
+// Transact applies ops in order under a single write lock, so no other
+// operation through the wrapper observes a partial transaction. If the
+// source of a rename or the target of a remove does not exist, or the
+// directory a path is to be created in, nothing is applied. If a step fails
+// while it is applied, the steps applied before it are rolled back: what
+// steps replace or remove is kept in a backup until the transaction is
+// complete.
+//
+// With WithWAL, the steps are recorded in the write-ahead log and the data
+// of TxWriteFile steps is staged next to its target before anything is
+// applied, and each step is logged once applied, so a crash midway is
+// completed or rolled back by the next wrapper created with the same log.
+func (f *Filer) Transact(ops ...TxOp) error {
+	return f.transact(f.ctx, ops)
+}
+
+// Transact applies ops in order under a single write lock, so no other
+// operation through the wrapper observes a partial transaction. If the
+// source of a rename or the target of a remove does not exist, or the
+// directory a path is to be created in, nothing is applied. If a step fails
+// while it is applied, the steps applied before it are rolled back: what
+// steps replace or remove is kept in a backup until the transaction is
+// complete.
+//
+// With WithWAL, the steps are recorded in the write-ahead log and the data
+// of TxWriteFile steps is staged next to its target before anything is
+// applied, and each step is logged once applied, so a crash midway is
+// completed or rolled back by the next wrapper created with the same log.
+func (f *FileSystem) Transact(ops ...TxOp) error {
+	return f.transact(f.ctx, ops)
+}
+
+// Transact applies ops in order under a single write lock, so no other
+// operation through the wrapper observes a partial transaction. If the
+// source of a rename or the target of a remove does not exist, or the
+// directory a path is to be created in, nothing is applied. If a step fails
+// while it is applied, the steps applied before it are rolled back: what
+// steps replace or remove is kept in a backup until the transaction is
+// complete.
+//
+// With WithWAL, the steps are recorded in the write-ahead log and the data
+// of TxWriteFile steps is staged next to its target before anything is
+// applied, and each step is logged once applied, so a crash midway is
+// completed or rolled back by the next wrapper created with the same log.
+func (f *SymlinkFileSystem) Transact(ops ...TxOp) error {
+	return f.transact(f.ctx, ops)
+}
+
+// walRecord is a line of the write-ahead log. A transaction is logged as a
+// "prepare" record listing its steps, followed by a "commit" record once its
+// data is staged, and a "done" record for each step once it is applied. If a
+// step fails, an "abort" record is logged before the applied steps are
+// rolled back.
+type walRecord struct {
+	Tx    uint64 `json:"tx"`
+	State string `json:"state"`
+	Ops   []TxOp `json:"ops,omitempty"`
+	Step  int    `json:"step,omitempty"` // for "done"
+}
+
+func (c *core) transact(ctx context.Context, ops []TxOp) (err error) {
+	// Record each step, with the outcome of the whole transaction.
+	defer func() {
+		for _, op := range ops {
+			rec := AuditRecord{Op: "tx" + op.Op, Path: op.Path, NewPath: op.NewPath}
+			if op.Op == "writefile" {
+				rec.Mode, rec.Size = &op.perm, int64ptr(len(op.data))
+			}
+			c.audit(ctx, &err, rec)
+		}
+	}()
+	var names []string
+	for _, op := range ops {
+		names = append(names, op.Path)
+		if op.Op == "rename" {
+			names = append(names, op.NewPath)
+		}
+	}
+	// The data of TxWriteFile steps is staged before the write lock is
+	// taken, so readers are not held up by syncing it.
+	ops = append([]TxOp(nil), ops...)
+	var temps []string
+	for i := range ops {
+		op := &ops[i]
+		if op.Op != "writefile" {
+			continue
+		}
+		op.Temp = txName(op.Path)
+		if err := c.stage(ctx, "transact", op.Path, op.Temp, op.data, op.perm); err != nil {
+			c.discard(temps...)
+			return err
+		}
+		temps = append(temps, op.Temp)
+	}
+	if err := c.acquireIdle(ctx, "transact", true, names...); err != nil {
+		c.discard(temps...)
+		return err
+	}
+	defer c.release(exclusive | mutating)
+	if err := c.validate(ops); err != nil {
+		c.unstage(ops)
+		return err
+	}
+
+	var log absfs.File
+	tx := rand.Uint64()
+	if c.wal != "" {
+		c.preserve([]string{c.abs(c.wal)}, false)
+		if log, err = c.base.OpenFile(c.wal, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			c.unstage(ops)
+			return err
+		}
+		resolved := false
+		defer func() {
+			log.Close()
+			if resolved {
+				c.base.Remove(c.wal)
+				c.invalidate(c.keys([]string{c.wal}), false)
+			}
+		}()
+		if err := appendWAL(log, walRecord{Tx: tx, State: "prepare", Ops: ops}); err != nil {
+			resolved = true
+			c.unstage(ops)
+			return err
+		}
+		defer func() {
+			// A transaction that could not be rolled back is left to
+			// recoverWAL.
+			resolved = !errors.Is(err, errRollback)
+		}()
+		if err := appendWAL(log, walRecord{Tx: tx, State: "commit"}); err != nil {
+			c.unstage(ops)
+			return err
+		}
+	}
+	return c.run(log, tx, ops, 0)
+}
+
+// validate checks that the steps of a transaction can be applied in order,
+// and names the backups they keep. The caller must hold the filesystem write
+// lock.
+func (c *core) validate(ops []TxOp) error {
+	sim := txState{c: c}
+	for i := range ops {
+		op := &ops[i]
+		switch op.Op {
+		case "rename", "remove":
+			if !sim.exists(op.Path) {
+				return &os.PathError{Op: op.Op, Path: op.Path, Err: os.ErrNotExist}
+			}
+			if c.deleteDenied(op.Path, true) || op.Op == "rename" && c.deleteDenied(op.NewPath, true) {
+				return &os.PathError{Op: op.Op, Path: op.Path, Err: ErrSharingViolation}
+			}
+			if op.Op == "rename" && !sim.exists(path.Dir(op.NewPath)) {
+				return &os.LinkError{Op: op.Op, Old: op.Path, New: op.NewPath, Err: os.ErrNotExist}
+			}
+			if op.Op == "rename" {
+				op.Backup = txName(op.NewPath)
+			} else {
+				op.Backup = txName(op.Path)
+			}
+		case "writefile":
+			if c.shareModes && c.handles.denies(c.abs(op.Path), false, DenyWrite|DenyDelete) {
+				return &os.PathError{Op: op.Op, Path: op.Path, Err: ErrSharingViolation}
+			}
+			if !sim.exists(path.Dir(op.Path)) {
+				return &os.PathError{Op: op.Op, Path: op.Path, Err: os.ErrNotExist}
+			}
+			op.Backup = txName(op.Path)
+		default:
+			return &os.PathError{Op: "transact", Path: op.Path, Err: fmt.Errorf("unknown step %q", op.Op)}
+		}
+		sim.ops = append(sim.ops, *op)
+	}
+	return nil
+}
+
+// errRollback is joined to the errors of transactions that could not be
+// rolled back.
+var errRollback = errors.New("transaction rollback failed")
+
+// txName returns a new name for a hidden file next to name, to stage data
+// or keep a backup in.
+func txName(name string) string {
+	dir, file := path.Split(name)
+	return path.Join(dir, fmt.Sprintf(".%s.tx-%016x", file, rand.Uint64()))
+}
+
+// txState tracks which paths exist after the steps of a transaction applied
+// so far, to validate the steps before anything is applied.
+type txState struct {
+	c   *core
+	ops []TxOp
+}
+
+// exists reports whether name exists after the steps in s.ops.
+func (s *txState) exists(name string) bool {
+	key := s.c.abs(name)
+	for i := len(s.ops) - 1; i >= 0; i-- {
+		op := s.ops[i]
+		switch old := s.c.abs(op.Path); op.Op {
+		case "rename":
+			if renamed := s.c.abs(op.NewPath); within(key, renamed) {
+				key = old + key[len(renamed):]
+			} else if within(key, old) {
+				return false
+			}
+		case "remove":
+			if within(key, old) {
+				return false
+			}
+		case "writefile":
+			if key == old {
+				return true
+			}
+			if within(key, old) {
+				return false
+			}
+		}
+	}
+	return s.c.present(key)
+}
+
+// present reports whether name exists, without following a symbolic link
+// at name.
+func (c *core) present(name string) bool {
+	if name == "" {
+		return false
+	}
+	_, err := c.lstat(name)
+	return err == nil
+}
+
+// unstage removes the staged data of ops. The caller must hold the
+// filesystem write lock.
+func (c *core) unstage(ops []TxOp) {
+	var temps []string
+	for _, op := range ops {
+		if op.Temp != "" {
+			c.base.Remove(op.Temp)
+			temps = append(temps, op.Temp)
+		}
+	}
+	c.invalidate(c.keys(temps), false)
+}
+
+// run applies the steps of a transaction whose data is staged, from step
+// first on, logging each step as done once it is applied. If a step fails,
+// run logs the transaction as aborted and rolls it back. The caller must
+// hold the filesystem write lock.
+func (c *core) run(log absfs.File, tx uint64, ops []TxOp, first int) error {
+	for i := first; i < len(ops); i++ {
+		err := c.step(ops[i])
+		if err == nil && log != nil {
+			err = appendWAL(log, walRecord{Tx: tx, State: "done", Step: i})
+		}
+		if err != nil {
+			if log != nil {
+				appendWAL(log, walRecord{Tx: tx, State: "abort"})
+			}
+			return errors.Join(err, c.rollback(ops, i))
+		}
+	}
+	for _, op := range ops {
+		if op.Backup != "" {
+			absfs.ExtendFiler(c.base).RemoveAll(op.Backup)
+		}
+	}
+	return nil
+}
+
+// step applies a step of a transaction, keeping a backup of what it
+// replaces or removes. Steps are applied in order, so if steps before op
+// are applied and op is not known to be, op is applied already if its source
+// is gone. A step interrupted by a crash is completed. The caller must hold
+// the filesystem write lock.
+func (c *core) step(op TxOp) error {
+	switch op.Op {
+	case "rename":
+		if !c.present(op.Path) {
+			return nil
+		}
+		if info, err := c.lstat(op.NewPath); err == nil && !info.IsDir() && !c.present(op.Backup) && op.Backup != "" {
+			if err := c.base.Rename(op.NewPath, op.Backup); err != nil {
+				return err
+			}
+		}
+		if err := c.rename(op.Path, op.NewPath); err != nil {
+			return err
+		}
+		c.renamed(op.Path, op.NewPath)
+	case "remove":
+		info, err := c.lstat(op.Path)
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			entries, err := c.base.ReadDir(op.Path)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				return &os.PathError{Op: "remove", Path: op.Path, Err: syscall.ENOTEMPTY}
+			}
+		}
+		if op.Backup == "" {
+			return c.mutated(c.base.Remove(op.Path), "remove", false, op.Path)
+		}
+		return c.mutated(c.base.Rename(op.Path, op.Backup), "remove", false, op.Path)
+	case "writefile":
+		if !c.present(op.Temp) {
+			return nil
+		}
+		if info, err := c.lstat(op.Path); err == nil {
+			if info.IsDir() {
+				return &os.PathError{Op: "writefile", Path: op.Path, Err: syscall.EISDIR}
+			}
+			if op.Backup != "" && !c.present(op.Backup) {
+				if err := c.base.Rename(op.Path, op.Backup); err != nil {
+					return err
+				}
+			}
+		}
+		return c.mutated(c.rename(op.Temp, op.Path), "writefile", false, op.Path)
+	}
+	return nil
+}
+
+// rollback undoes the steps of a transaction up to and including step last,
+// which may be partially applied, in reverse order, and removes the staged
+// data. Each step is undone from the state the steps after it were undone
+// to, so rollback can be repeated after a crash. If it fails, the returned
+// error wraps errRollback. The caller must hold the filesystem write lock.
+func (c *core) rollback(ops []TxOp, last int) error {
+	var errs []error
+	for i := last; i >= 0; i-- {
+		if err := c.undo(ops[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", errRollback, errors.Join(errs...))
+	}
+	c.unstage(ops)
+	return nil
+}
+
+// undo undoes a step of a transaction, and restores the backup it kept.
+func (c *core) undo(op TxOp) error {
+	switch op.Op {
+	case "rename":
+		if !c.present(op.Path) && c.present(op.NewPath) {
+			if err := c.base.Rename(op.NewPath, op.Path); err != nil {
+				return err
+			}
+			c.renamed(op.NewPath, op.Path)
+		}
+		if c.present(op.Backup) {
+			return c.mutated(c.base.Rename(op.Backup, op.NewPath), "create", false, op.NewPath)
+		}
+	case "remove":
+		if c.present(op.Backup) {
+			return c.mutated(c.base.Rename(op.Backup, op.Path), "create", false, op.Path)
+		}
+	case "writefile":
+		if !c.present(op.Temp) && c.present(op.Path) {
+			if err := c.base.Rename(op.Path, op.Temp); err != nil {
+				return err
+			}
+			c.mutated(nil, "remove", false, op.Path)
+		}
+		if c.present(op.Backup) {
+			return c.mutated(c.base.Rename(op.Backup, op.Path), "writefile", false, op.Path)
+		}
+	}
+	return nil
+}
+
+// appendWAL appends rec to the write-ahead log and syncs it.
+func appendWAL(log absfs.File, rec walRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return log.Sync()
+}
+
+// recoverWAL completes the transaction recorded in the write-ahead log if it
+// was committed, rolls it back if it was aborted or a step fails, removes
+// its staged data otherwise, and removes the log. If the transaction cannot
+// be rolled back, the log is kept and an error is returned.
+func (c *core) recoverWAL() error {
+	if c.wal == "" {
+		return nil
+	}
+	data, err := c.base.ReadFile(c.wal)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var prepared *walRecord
+	committed, aborted, done := false, false, 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var rec walRecord
+		if json.Unmarshal(line, &rec) != nil {
+			// A torn record, written when the crash happened.
+			break
+		}
+		if rec.State == "prepare" {
+			prepared, committed, aborted, done = &rec, false, false, 0
+			continue
+		}
+		if prepared == nil || rec.Tx != prepared.Tx {
+			continue
+		}
+		switch rec.State {
+		case "commit":
+			committed = true
+		case "done":
+			done = rec.Step + 1
+		case "abort":
+			aborted = true
+		}
+	}
+	if prepared != nil {
+		ops := prepared.Ops
+		switch {
+		case !committed:
+			c.unstage(ops)
+		case aborted:
+			err = c.rollback(ops, min(done, len(ops)-1))
+		default:
+			var log absfs.File
+			if log, err = c.base.OpenFile(c.wal, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+				return err
+			}
+			err = c.run(log, prepared.Tx, ops, done)
+			log.Close()
+		}
+		if errors.Is(err, errRollback) {
+			return err
+		}
+	}
+	return c.base.Remove(c.wal)
+}
@@ -0,0 +1,326 @@
+package lockfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// writeWAL writes a write-ahead log holding records to name in fsys, as a
+// crash would have left it.
+func writeWAL(t *testing.T, fsys absfs.FileSystem, name string, records ...walRecord) {
+	t.Helper()
+	f, err := fsys.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, rec := range records {
+		if err := appendWAL(f, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestTransact tests that Transact applies all steps and removes the log.
+func TestTransact(t *testing.T) {
+	fsys := newShareFS(t, WithWAL("/tx.log"))
+	if err := fsys.WriteFileAtomic("/dir/old.txt", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := fsys.Transact(
+		TxWriteFile("/dir/new.txt", []byte("new"), 0644),
+		TxRename("/dir/file.txt", "/dir/renamed.txt"),
+		TxRemove("/dir/old.txt"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := fsys.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 || names[0] != "new.txt" || names[1] != "renamed.txt" {
+		t.Errorf("expected new.txt and renamed.txt, got %v", names)
+	}
+	if _, err := fsys.Stat("/tx.log"); !os.IsNotExist(err) {
+		t.Errorf("expected the log to be removed, got %v", err)
+	}
+
+	// A step that cannot be applied aborts the whole transaction.
+	err = fsys.Transact(TxWriteFile("/dir/other.txt", nil, 0644), TxRemove("/dir/missing.txt"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if _, err := fsys.Stat("/dir/other.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be applied, got %v", err)
+	}
+}
+
+// TestWALRecovery tests that a committed transaction interrupted by a crash
+// is completed when the wrapper is created again.
+func TestWALRecovery(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The rename was applied before the crash, the staged write was not.
+	for name, data := range map[string]string{"/dir/renamed.txt": "a", "/dir/.new.txt.tx-1": "staged"} {
+		f, err := mfs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(data))
+		f.Close()
+	}
+	ops := []TxOp{
+		TxRename("/dir/file.txt", "/dir/renamed.txt"),
+		{Op: "writefile", Path: "/dir/new.txt", Temp: "/dir/.new.txt.tx-1"},
+	}
+	writeWAL(t, mfs, "/tx.log", walRecord{Tx: 1, State: "prepare", Ops: ops}, walRecord{Tx: 1, State: "commit"})
+
+	fsys, err := NewFS(mfs, WithWAL("/tx.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fsys.ReadFile("/dir/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "staged" {
+		t.Errorf("expected %q, got %q", "staged", data)
+	}
+	if _, err := fsys.Stat("/dir/.new.txt.tx-1"); !os.IsNotExist(err) {
+		t.Errorf("expected the staged file to be renamed, got %v", err)
+	}
+	if _, err := fsys.Stat("/tx.log"); !os.IsNotExist(err) {
+		t.Errorf("expected the log to be removed, got %v", err)
+	}
+}
+
+// TestWALRollback tests that an uncommitted transaction interrupted by a
+// crash is rolled back when the wrapper is created again.
+func TestWALRollback(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := mfs.Create("/.new.txt.tx-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	ops := []TxOp{{Op: "writefile", Path: "/new.txt", Temp: "/.new.txt.tx-1"}}
+	writeWAL(t, mfs, "/tx.log", walRecord{Tx: 1, State: "prepare", Ops: ops})
+	// Append a record torn by the crash.
+	log, err := mfs.OpenFile("/tx.log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := json.Marshal(walRecord{Tx: 1, State: "commit"})
+	log.Write(line[:len(line)/2])
+	log.Close()
+
+	fsys, err := NewFS(mfs, WithWAL("/tx.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fsys.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the staged file and the log to be removed, got %v", entries)
+	}
+}
+
+// TestWALReplayAppliedSteps tests that replaying a log skips the steps
+// logged as done, and the step interrupted by the crash if it was applied,
+// so paths recreated by later steps are left alone.
+func TestWALReplayAppliedSteps(t *testing.T) {
+	for _, done := range []int{0, 1, 2} {
+		mfs, err := memfs.NewFS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// [remove /c, rename /d to /c] was applied before the crash, up to
+		// step done, which may not have been logged yet.
+		files := map[string]string{"/.c.tx-1": "old c", "/c": "from d"}
+		if done == 0 {
+			files = map[string]string{"/.c.tx-1": "old c", "/d": "from d"}
+		}
+		for name, data := range files {
+			f, err := mfs.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte(data))
+			f.Close()
+		}
+		ops := []TxOp{
+			{Op: "remove", Path: "/c", Backup: "/.c.tx-1"},
+			{Op: "rename", Path: "/d", NewPath: "/c", Backup: "/.c.tx-2"},
+		}
+		records := []walRecord{{Tx: 1, State: "prepare", Ops: ops}, {Tx: 1, State: "commit"}}
+		for i := 0; i < done; i++ {
+			records = append(records, walRecord{Tx: 1, State: "done", Step: i})
+		}
+		writeWAL(t, mfs, "/tx.log", records...)
+
+		fsys, err := NewFS(mfs, WithWAL("/tx.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := fsys.ReadFile("/c"); err != nil || string(data) != "from d" {
+			t.Errorf("%d steps logged as done: /c = %q, %v, want %q", done, data, err, "from d")
+		}
+		if entries, _ := fsys.ReadDir("/"); len(entries) != 1 {
+			t.Errorf("%d steps logged as done: expected only /c to remain, got %v", done, entries)
+		}
+	}
+}
+
+// renameFailFS fails renames to /fail.
+type renameFailFS struct {
+	absfs.FileSystem
+}
+
+func (fs *renameFailFS) Rename(oldpath, newpath string) error {
+	if newpath == "/fail" {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrPermission}
+	}
+	return fs.FileSystem.Rename(oldpath, newpath)
+}
+
+// TestTransactRollback tests that a transaction whose step fails while it
+// is applied is rolled back, leaving no staged data or backups behind.
+func TestTransactRollback(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(&renameFailFS{mfs}, WithWAL("/tx.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a", "/b", "/x"} {
+		if err := fsys.WriteFileAtomic(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = fsys.Transact(
+		TxWriteFile("/a", []byte("new"), 0644),
+		TxRemove("/b"),
+		TxRename("/x", "/y"),
+		TxRename("/y", "/fail"),
+	)
+	if !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	entries, err := fsys.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "x" {
+		t.Errorf("expected a, b and x, got %v", names)
+	}
+	for _, name := range []string{"/a", "/b", "/x"} {
+		if data, err := fsys.ReadFile(name); err != nil || string(data) != name {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, name)
+		}
+	}
+
+	// A destination in a missing directory is rejected up front.
+	err = fsys.Transact(TxWriteFile("/a", []byte("new"), 0644), TxRename("/x", "/nodir/y"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if data, _ := fsys.ReadFile("/a"); string(data) != "/a" {
+		t.Errorf("/a = %q, want %q", data, "/a")
+	}
+}
+
+// TestWALRecoverAbort tests that a transaction aborted before a crash is
+// rolled back when the wrapper is created again.
+func TestWALRecoverAbort(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The write was applied, and the failing rename was not.
+	for name, data := range map[string]string{"/a": "new", "/.a.tx-2": "old", "/x": "x"} {
+		f, err := mfs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(data))
+		f.Close()
+	}
+	ops := []TxOp{
+		{Op: "writefile", Path: "/a", Temp: "/.a.tx-1", Backup: "/.a.tx-2"},
+		{Op: "rename", Path: "/x", NewPath: "/fail", Backup: "/.fail.tx-3"},
+	}
+	writeWAL(t, mfs, "/tx.log",
+		walRecord{Tx: 1, State: "prepare", Ops: ops},
+		walRecord{Tx: 1, State: "commit"},
+		walRecord{Tx: 1, State: "done", Step: 0},
+		walRecord{Tx: 1, State: "abort"})
+
+	fsys, err := NewFS(mfs, WithWAL("/tx.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fsys.ReadFile("/a"); err != nil || string(data) != "old" {
+		t.Errorf("/a = %q, %v, want %q", data, err, "old")
+	}
+	if entries, _ := fsys.ReadDir("/"); len(entries) != 2 {
+		t.Errorf("expected only /a and /x to remain, got %v", entries)
+	}
+}
+
+// TestTransactAudit tests that each step of a transaction is recorded in
+// the audit log.
+func TestTransactAudit(t *testing.T) {
+	var buf bytes.Buffer
+	fsys := newShareFS(t, WithAudit(&buf))
+	alice := fsys.WithContext(WithPrincipal(fsys.ctx, "alice"))
+	buf.Reset()
+
+	err := alice.Transact(
+		TxWriteFile("/dir/new.txt", []byte("new"), 0644),
+		TxRename("/dir/file.txt", "/dir/renamed.txt"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAudit(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	write, rename := records[0], records[1]
+	if write.Op != "txwritefile" || write.Path != "/dir/new.txt" || write.Size == nil || *write.Size != 3 || write.Principal != "alice" {
+		t.Errorf("unexpected write record %+v", write)
+	}
+	if rename.Op != "txrename" || rename.Path != "/dir/file.txt" || rename.NewPath != "/dir/renamed.txt" || rename.Error != "" {
+		t.Errorf("unexpected rename record %+v", rename)
+	}
+}
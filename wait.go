@@ -0,0 +1,131 @@
+package lockfs
+
+import (
+	"context"
+)
+
+// WaitExists blocks until name exists, or ctx is done. Only mutations made
+// through the wrapper wake it up.
+func (f *Filer) WaitExists(ctx context.Context, name string) error {
+	return f.waitPath(ctx, "waitexists", name, f.exists)
+}
+
+// WaitRemoved blocks until name does not exist, or ctx is done. Only
+// mutations made through the wrapper wake it up.
+func (f *Filer) WaitRemoved(ctx context.Context, name string) error {
+	return f.waitPath(ctx, "waitremoved", name, func(name string) bool { return !f.exists(name) })
+}
+
+// WaitModified blocks until the generation of name is past sinceGen, or ctx
+// is done, and returns the new generation.
+func (f *Filer) WaitModified(ctx context.Context, name string, sinceGen uint64) (uint64, error) {
+	return f.waitModified(ctx, name, sinceGen)
+}
+
+// WaitExists blocks until name exists, or ctx is done. Only mutations made
+// through the wrapper wake it up.
+func (f *FileSystem) WaitExists(ctx context.Context, name string) error {
+	return f.waitPath(ctx, "waitexists", name, f.exists)
+}
+
+// WaitRemoved blocks until name does not exist, or ctx is done. Only
+// mutations made through the wrapper wake it up.
+func (f *FileSystem) WaitRemoved(ctx context.Context, name string) error {
+	return f.waitPath(ctx, "waitremoved", name, func(name string) bool { return !f.exists(name) })
+}
+
+// WaitModified blocks until the generation of name is past sinceGen, or ctx
+// is done, and returns the new generation.
+func (f *FileSystem) WaitModified(ctx context.Context, name string, sinceGen uint64) (uint64, error) {
+	return f.waitModified(ctx, name, sinceGen)
+}
+
+// WaitExists blocks until name exists, or ctx is done. Only mutations made
+// through the wrapper wake it up.
+func (f *SymlinkFileSystem) WaitExists(ctx context.Context, name string) error {
+	return f.waitPath(ctx, "waitexists", name, f.exists)
+}
+
+// WaitRemoved blocks until name does not exist, or ctx is done. Only
+// mutations made through the wrapper wake it up.
+func (f *SymlinkFileSystem) WaitRemoved(ctx context.Context, name string) error {
+	return f.waitPath(ctx, "waitremoved", name, func(name string) bool { return !f.exists(name) })
+}
+
+// WaitModified blocks until the generation of name is past sinceGen, or ctx
+// is done, and returns the new generation.
+func (f *SymlinkFileSystem) WaitModified(ctx context.Context, name string, sinceGen uint64) (uint64, error) {
+	return f.waitModified(ctx, name, sinceGen)
+}
+
+func (c *core) waitModified(ctx context.Context, name string, sinceGen uint64) (uint64, error) {
+	var gen uint64
+	err := c.waitPath(ctx, "waitmodified", name, func(name string) bool {
+		gen = c.gens.get(c.abs(name))
+		return gen > sinceGen
+	})
+	return gen, err
+}
+
+// waitPath blocks until done reports true for name, checking it under the
+// filesystem read lock whenever name may have changed.
+func (c *core) waitPath(ctx context.Context, op string, name string, done func(name string) bool) error {
+	for {
+		if err := c.acquire(ctx, op, shared, name); err != nil {
+			return err
+		}
+		// Register before checking, so a mutation right after the check
+		// is not missed.
+		wait := c.gens.wait(c.abs(name))
+		ok := done(name)
+		c.release(shared)
+		if ok {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// wait returns a channel that is closed when key, a path beneath it or a
+// tree containing it changes.
+func (g *generations) wait(key string) <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.waiting == nil {
+		g.waiting = make(map[string]chan struct{})
+	}
+	ch := g.waiting[key]
+	if ch == nil {
+		ch = make(chan struct{})
+		g.waiting[key] = ch
+	}
+	return ch
+}
+
+// wake wakes the waits for the paths concerned by a change of keys, or of
+// the trees beneath them if tree is set. The caller must hold g.mu.
+func (g *generations) wake(keys []string, tree bool) {
+	for waited, ch := range g.waiting {
+		for _, key := range keys {
+			if within(key, waited) || tree && within(waited, key) {
+				close(ch)
+				delete(g.waiting, waited)
+				break
+			}
+		}
+	}
+}
+
+// wakeAll wakes all waits.
+func (g *generations) wakeAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for waited, ch := range g.waiting {
+		close(ch)
+		delete(g.waiting, waited)
+	}
+}
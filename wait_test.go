@@ -0,0 +1,122 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitAsync runs wait in a goroutine and returns a channel receiving its
+// result.
+func waitAsync(wait func() error) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- wait()
+	}()
+	return done
+}
+
+// expectPending fails the test if done delivers a result within a short
+// time.
+func expectPending(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("wait returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// expectDone fails the test unless done delivers a nil result.
+func expectDone(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return")
+	}
+}
+
+// TestWaitExistsRemoved tests that WaitExists and WaitRemoved return once
+// the path is created or removed.
+func TestWaitExistsRemoved(t *testing.T) {
+	fsys := newShareFS(t)
+	ctx := context.Background()
+
+	if err := fsys.WaitExists(ctx, "/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := waitAsync(func() error { return fsys.WaitExists(ctx, "/ready/marker") })
+	expectPending(t, exists)
+	if err := fsys.Mkdir("/unrelated", 0755); err != nil {
+		t.Fatal(err)
+	}
+	expectPending(t, exists)
+	if err := fsys.MkdirAll("/ready/marker", 0755); err != nil {
+		t.Fatal(err)
+	}
+	expectDone(t, exists)
+
+	removed := waitAsync(func() error { return fsys.WaitRemoved(ctx, "/dir/file.txt") })
+	expectPending(t, removed)
+	if err := fsys.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	expectDone(t, removed)
+}
+
+// TestWaitModified tests that WaitModified returns once the path is
+// mutated past the given generation.
+func TestWaitModified(t *testing.T) {
+	fsys := newShareFS(t)
+	ctx := context.Background()
+
+	_, gen, err := fsys.ReadFileVersion("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var newGen uint64
+	modified := waitAsync(func() (err error) {
+		newGen, err = fsys.WaitModified(ctx, "/dir/file.txt", gen)
+		return err
+	})
+	expectPending(t, modified)
+	if err := fsys.WriteFileAtomic("/dir/file.txt", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectDone(t, modified)
+	if newGen <= gen {
+		t.Errorf("expected a generation past %d, got %d", gen, newGen)
+	}
+}
+
+// TestWaitCanceled tests that waits return when their context is done or
+// the wrapper is closed.
+func TestWaitCanceled(t *testing.T) {
+	fsys := newShareFS(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := fsys.WaitExists(ctx, "/missing"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+
+	done := waitAsync(func() error { return fsys.WaitExists(context.Background(), "/missing") })
+	expectPending(t, done)
+	if err := fsys.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after Close")
+	}
+}
@@ -0,0 +1,205 @@
+package lockfs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// WalkMode selects how consistent the tree visited by WalkDir is.
+type WalkMode uint8
+
+const (
+	// WalkSnapshot reads the whole tree under a single read lock before
+	// visiting it, so the walk sees the tree as it was at one point in time.
+	WalkSnapshot WalkMode = iota
+
+	// WalkPerDirectory reads each directory under its own read lock as the
+	// walk reaches it. Each directory listing and the metadata of its entries
+	// are consistent with each other, but mutations may happen between
+	// directories. Directories skipped with fs.SkipDir are never read.
+	WalkPerDirectory
+)
+
+// WalkDir walks the tree rooted at root like fs.WalkDir, calling fn for
+// every file and directory in it, with the consistency selected by mode.
+// Symbolic links are not followed. fn is called without any lock held, so
+// it may use the wrapper freely.
+func (f *Filer) WalkDir(root string, mode WalkMode, fn fs.WalkDirFunc) error {
+	return f.walkDir(f.ctx, root, mode, fn)
+}
+
+// WalkDir walks the tree rooted at root like fs.WalkDir, calling fn for
+// every file and directory in it, with the consistency selected by mode.
+// Symbolic links are not followed. fn is called without any lock held, so
+// it may use the wrapper freely.
+func (f *FileSystem) WalkDir(root string, mode WalkMode, fn fs.WalkDirFunc) error {
+	return f.walkDir(f.ctx, root, mode, fn)
+}
+
+// WalkDir walks the tree rooted at root like fs.WalkDir, calling fn for
+// every file and directory in it, with the consistency selected by mode.
+// Symbolic links are not followed. fn is called without any lock held, so
+// it may use the wrapper freely.
+func (f *SymlinkFileSystem) WalkDir(root string, mode WalkMode, fn fs.WalkDirFunc) error {
+	return f.walkDir(f.ctx, root, mode, fn)
+}
+
+// walkNode is a directory entry read by a walk.
+type walkNode struct {
+	name     string // path of the entry
+	entry    fs.DirEntry
+	children []*walkNode
+	err      error // error reading the directory
+	read     bool  // whether children and err are set
+}
+
+func (c *core) walkDir(ctx context.Context, root string, mode WalkMode, fn fs.WalkDirFunc) error {
+	if err := c.acquire(ctx, "walk", shared, root); err != nil {
+		return fn(root, nil, err)
+	}
+	info, err := c.lstat(root)
+	if err != nil {
+		c.release(shared)
+		return fn(root, nil, err)
+	}
+	top := &walkNode{name: root, entry: fs.FileInfoToDirEntry(info)}
+	if mode == WalkSnapshot {
+		c.readTree(top)
+	}
+	c.release(shared)
+
+	read := func(n *walkNode) error {
+		if n.read {
+			return nil
+		}
+		if err := c.acquire(ctx, "walk", shared, n.name); err != nil {
+			return err
+		}
+		defer c.release(shared)
+		c.readDir(n)
+		return nil
+	}
+	err = walkNodes(top, read, fn)
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkNodes visits n and, unless fn skips it, the children of n, reading
+// directories with read.
+func walkNodes(n *walkNode, read func(*walkNode) error, fn fs.WalkDirFunc) error {
+	if err := fn(n.name, n.entry, nil); err != nil || !n.entry.IsDir() {
+		if err == fs.SkipDir && n.entry.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	err := read(n)
+	if err == nil {
+		err = n.err
+	}
+	if err != nil {
+		// Second call, to report the error reading the directory.
+		if err = fn(n.name, n.entry, err); err != nil {
+			if err == fs.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, child := range n.children {
+		if err := walkNodes(child, read, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// readTree reads the tree beneath n. The caller must hold the filesystem
+// lock.
+func (c *core) readTree(n *walkNode) {
+	if !n.entry.IsDir() {
+		return
+	}
+	c.readDir(n)
+	for _, child := range n.children {
+		c.readTree(child)
+	}
+}
+
+// readDir reads the entries of directory n, in lexical order. The caller
+// must hold the filesystem lock.
+func (c *core) readDir(n *walkNode) {
+	n.read = true
+	entries, err := c.base.ReadDir(n.name)
+	if err != nil {
+		n.err = err
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		name := path.Join(n.name, e.Name())
+		info, err := c.lstat(name)
+		if err != nil {
+			n.err = err
+			return
+		}
+		n.children = append(n.children, &walkNode{name: name, entry: fs.FileInfoToDirEntry(info)})
+	}
+}
+
+// lstat returns a copy of the metadata of name in the wrapped filesystem,
+// without following symbolic links if it supports them. The caller must hold
+// the filesystem lock.
+func (c *core) lstat(name string) (fs.FileInfo, error) {
+	var info os.FileInfo
+	var err error
+	if sl, ok := c.base.(absfs.SymLinker); ok {
+		info, err = sl.Lstat(name)
+	} else {
+		info, err = c.base.Stat(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshotInfo(info), nil
+}
+
+// fileInfo is a copy of an fs.FileInfo, taken while the filesystem lock is
+// held. Some filesystems return FileInfo values that keep referring to the
+// live file, which would change under a caller that uses them after the lock
+// is released.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	sys     any
+}
+
+func snapshotInfo(info fs.FileInfo) fs.FileInfo {
+	return &fileInfo{
+		name:    info.Name(),
+		size:    info.Size(),
+		mode:    info.Mode(),
+		modTime: info.ModTime(),
+		sys:     info.Sys(),
+	}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() any           { return fi.sys }
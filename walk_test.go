@@ -0,0 +1,96 @@
+package lockfs
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+// walkPaths walks /data in fsys with mode, calling visit for every path, and
+// returns the paths visited.
+func walkPaths(t *testing.T, fsys *SymlinkFileSystem, mode WalkMode, visit func(string, fs.DirEntry) error) []string {
+	t.Helper()
+	var paths []string
+	err := fsys.WalkDir("/data", mode, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, name)
+		if visit != nil {
+			return visit(name, d)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+// TestWalkDir tests that WalkDir visits the tree in lexical order in both
+// modes, without following symbolic links.
+func TestWalkDir(t *testing.T) {
+	fsys := newExportFS(t)
+	want := []string{"/data", "/data/link", "/data/sub", "/data/sub/file.txt"}
+	for _, mode := range []WalkMode{WalkSnapshot, WalkPerDirectory} {
+		got := walkPaths(t, fsys, mode, func(name string, d fs.DirEntry) error {
+			if name == "/data/link" && d.Type()&fs.ModeSymlink == 0 {
+				t.Errorf("mode %d: expected %s to be a symlink, got %v", mode, name, d.Type())
+			}
+			return nil
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %d: expected %v, got %v", mode, want, got)
+		}
+	}
+}
+
+// TestWalkDirSkip tests that fs.SkipDir and fs.SkipAll are honored.
+func TestWalkDirSkip(t *testing.T) {
+	fsys := newExportFS(t)
+	got := walkPaths(t, fsys, WalkPerDirectory, func(name string, d fs.DirEntry) error {
+		if name == "/data/sub" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if want := []string{"/data", "/data/link", "/data/sub"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SkipDir: expected %v, got %v", want, got)
+	}
+	got = walkPaths(t, fsys, WalkSnapshot, func(name string, d fs.DirEntry) error {
+		if name == "/data/link" {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if want := []string{"/data", "/data/link"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SkipAll: expected %v, got %v", want, got)
+	}
+}
+
+// TestWalkDirConsistency tests that a snapshot walk is not affected by
+// mutations made during the walk, while a per-directory walk sees them in
+// directories it has not read yet. Mutating from the callback also shows
+// that it runs without the filesystem lock held.
+func TestWalkDirConsistency(t *testing.T) {
+	rename := func(fsys *SymlinkFileSystem) func(string, fs.DirEntry) error {
+		return func(name string, d fs.DirEntry) error {
+			if name == "/data" {
+				return fsys.Rename("/data/sub/file.txt", "/data/sub/moved.txt")
+			}
+			return nil
+		}
+	}
+
+	fsys := newExportFS(t)
+	got := walkPaths(t, fsys, WalkSnapshot, rename(fsys))
+	if want := []string{"/data", "/data/link", "/data/sub", "/data/sub/file.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkSnapshot: expected %v, got %v", want, got)
+	}
+
+	fsys = newExportFS(t)
+	got = walkPaths(t, fsys, WalkPerDirectory, rename(fsys))
+	if want := []string{"/data", "/data/link", "/data/sub", "/data/sub/moved.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkPerDirectory: expected %v, got %v", want, got)
+	}
+}
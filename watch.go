@@ -0,0 +1,221 @@
+package lockfs
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// EventOp describes the mutation an Event reports.
+type EventOp uint8
+
+const (
+	// Create reports that a file, directory or symbolic link was created.
+	Create EventOp = 1 << iota
+
+	// Write reports that a file was written to or truncated, or that a tree
+	// was replaced by ImportTar.
+	Write
+
+	// Remove reports that a path, or a tree containing it, was removed.
+	Remove
+
+	// Rename reports that a path, or a tree containing it, was renamed.
+	Rename
+
+	// Chmod reports that the mode, owner or times of a path changed.
+	Chmod
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case Create:
+		return "CREATE"
+	case Write:
+		return "WRITE"
+	case Remove:
+		return "REMOVE"
+	case Rename:
+		return "RENAME"
+	case Chmod:
+		return "CHMOD"
+	}
+	return "UNKNOWN"
+}
+
+// eventOps maps the operations recorded by mutated to the events they
+// report.
+var eventOps = map[string]EventOp{
+	"create":    Create,
+	"mkdir":     Create,
+	"symlink":   Create,
+	"write":     Write,
+	"writefile": Write,
+	"truncate":  Write,
+	"import":    Write,
+	"remove":    Remove,
+	"removeall": Remove,
+	"rename":    Rename,
+	"chmod":     Chmod,
+	"chown":     Chmod,
+	"lchown":    Chmod,
+	"chtimes":   Chmod,
+}
+
+// Event reports a mutation made through a wrapper.
+type Event struct {
+	Op      EventOp
+	Path    string // absolute path mutated
+	OldPath string // absolute path renamed from, for Rename
+	Gen     uint64 // generation of the mutation
+}
+
+// Watch reports the mutations made through the wrapper to name on the
+// returned channel, in the manner of fsnotify: if name is a directory, the
+// mutations of its entries are reported too, and of the whole tree beneath
+// it if recursive is set. Removing or renaming a tree containing name is
+// reported as well.
+//
+// Events are delivered in order, once the operation that caused them has
+// released the filesystem lock. They are queued without bound until they
+// are received, so a slow receiver never holds up the wrapper. Calling the
+// returned function stops the watch, drops the queued events and closes the
+// channel; closing the wrapper stops all its watches.
+func (c *core) Watch(name string, recursive bool) (<-chan Event, func()) {
+	w := &watcher{
+		c:         c,
+		key:       c.key(name),
+		recursive: recursive,
+		ch:        make(chan Event),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	c.watchers.add(w)
+	go w.deliver()
+	return w.ch, func() { c.watchers.cancel(w) }
+}
+
+// watchers holds the watches of a wrapper.
+type watchers struct {
+	mu    sync.Mutex
+	set   map[*watcher]struct{}
+	count atomic.Int32
+}
+
+func (ws *watchers) add(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.set == nil {
+		ws.set = make(map[*watcher]struct{})
+	}
+	ws.set[w] = struct{}{}
+	ws.count.Add(1)
+}
+
+func (ws *watchers) cancel(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.set[w]; ok {
+		delete(ws.set, w)
+		ws.count.Add(-1)
+		close(w.done)
+	}
+}
+
+func (ws *watchers) cancelAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.set {
+		delete(ws.set, w)
+		ws.count.Add(-1)
+		close(w.done)
+	}
+}
+
+// notify queues ch for the watches it concerns.
+func (ws *watchers) notify(ch Change) {
+	if ws.count.Load() == 0 {
+		return
+	}
+	op, ok := eventOps[ch.Op]
+	if !ok {
+		return
+	}
+	ev := Event{Op: op, Path: ch.Path, OldPath: ch.OldPath, Gen: ch.Gen}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.set {
+		if w.matches(ch.Path, ch.Tree) || ch.OldPath != "" && w.matches(ch.OldPath, ch.Tree) {
+			w.push(ev)
+		}
+	}
+}
+
+// watcher is a single watch.
+type watcher struct {
+	c         *core
+	key       string
+	recursive bool
+
+	mu    sync.Mutex
+	queue []Event
+
+	ch   chan Event
+	wake chan struct{} // signalled when an event is queued
+	done chan struct{} // closed when the watch is stopped
+}
+
+// matches reports whether a mutation of key, or of the tree beneath it if
+// tree is set, concerns the watch.
+func (w *watcher) matches(key string, tree bool) bool {
+	switch {
+	case key == w.key || path.Dir(key) == w.key:
+		return true
+	case w.recursive && within(key, w.key):
+		return true
+	}
+	return tree && within(w.key, key)
+}
+
+func (w *watcher) push(ev Event) {
+	w.mu.Lock()
+	w.queue = append(w.queue, ev)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the queued events on the channel until the watch is
+// stopped.
+func (w *watcher) deliver() {
+	defer close(w.ch)
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+		ev := w.queue[0]
+		w.queue[0] = Event{}
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		// Wait for the operation that queued the event to release the
+		// filesystem write lock.
+		w.c.m.RLock()
+		w.c.m.RUnlock()
+
+		select {
+		case w.ch <- ev:
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package lockfs
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event from events, failing the test if none
+// arrives.
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("event channel closed")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered")
+	}
+	return Event{}
+}
+
+// TestWatch tests that mutations of a directory and its entries are
+// reported in order.
+func TestWatch(t *testing.T) {
+	fsys := newShareFS(t)
+	events, cancel := fsys.Watch("/dir", false)
+	defer cancel()
+
+	f, err := fsys.Create("/dir/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	f.Close()
+	if err := fsys.Chmod("/dir/new.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename("/dir/new.txt", "/dir/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("/dir/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// Neither an entry of /dir nor /dir itself.
+	if err := fsys.Mkdir("/other", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Event{
+		{Op: Create, Path: "/dir/new.txt"},
+		{Op: Write, Path: "/dir/new.txt"},
+		{Op: Chmod, Path: "/dir/new.txt"},
+		{Op: Rename, Path: "/dir/renamed.txt", OldPath: "/dir/new.txt"},
+		{Op: Remove, Path: "/dir/renamed.txt"},
+		{Op: Create, Path: "/dir/sub"},
+	}
+	for i, w := range want {
+		ev := nextEvent(t, events)
+		if ev.Op != w.Op || ev.Path != w.Path || ev.OldPath != w.OldPath {
+			t.Errorf("event %d: expected %v %s, got %v %s", i, w.Op, w.Path, ev.Op, ev.Path)
+		}
+	}
+}
+
+// TestWatchRecursive tests that recursive watches report mutations deep in
+// the tree, and that watches report the removal of trees containing them.
+func TestWatchRecursive(t *testing.T) {
+	fsys := newShareFS(t)
+	if err := fsys.MkdirAll("/dir/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	shallow, cancelShallow := fsys.Watch("/dir", false)
+	defer cancelShallow()
+	deep, cancelDeep := fsys.Watch("/dir", true)
+	defer cancelDeep()
+	inner, cancelInner := fsys.Watch("/dir/a/b", false)
+	defer cancelInner()
+
+	if err := fsys.WriteFileAtomic("/dir/a/b/file.txt", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := nextEvent(t, deep); ev.Op != Create || ev.Path != "/dir/a/b/file.txt" {
+		t.Errorf("recursive: expected create of /dir/a/b/file.txt, got %v %s", ev.Op, ev.Path)
+	}
+	if ev := nextEvent(t, deep); ev.Op != Remove || ev.Path != "/dir" {
+		t.Errorf("recursive: expected removal of /dir, got %v %s", ev.Op, ev.Path)
+	}
+	if ev := nextEvent(t, shallow); ev.Op != Remove || ev.Path != "/dir" {
+		t.Errorf("shallow: expected only the removal of /dir, got %v %s", ev.Op, ev.Path)
+	}
+	if ev := nextEvent(t, inner); ev.Op != Create {
+		t.Errorf("inner: expected create, got %v %s", ev.Op, ev.Path)
+	}
+	if ev := nextEvent(t, inner); ev.Op != Remove || ev.Path != "/dir" {
+		t.Errorf("inner: expected removal of /dir, got %v %s", ev.Op, ev.Path)
+	}
+}
+
+// TestWatchDelivery tests that events are queued for slow receivers, that
+// receivers may use the wrapper, and that stopping a watch closes the
+// channel.
+func TestWatchDelivery(t *testing.T) {
+	fsys := newShareFS(t)
+	events, cancel := fsys.Watch("/dir/file.txt", false)
+
+	f, err := fsys.OpenFile("/dir/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := f.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	for i := 0; i < 100; i++ {
+		if ev := nextEvent(t, events); ev.Op != Write {
+			t.Fatalf("expected write, got %v", ev.Op)
+		}
+		if _, err := fsys.Stat("/dir/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected the channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+	cancel()
+
+	events, _ = fsys.Watch("/dir", true)
+	if err := fsys.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("expected Close to stop the watch")
+	}
+}
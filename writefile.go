@@ -0,0 +1,147 @@
+package lockfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+)
+
+// WriteFileAtomic writes data to the named file, creating it with perm if
+// necessary; an existing file keeps its permissions. The data is written to
+// a temporary file next to it, which is synced and renamed over the file, so
+// readers see either the old content or all of the new one. This holds even
+// if the wrapped filesystem crashes midway, provided it can rename over an
+// existing file, as OS filesystems can; on those that cannot, the file is
+// removed before the rename, and a crash in between loses it.
+func (f *Filer) WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return f.writeFileAtomic(f.ctx, name, data, perm)
+}
+
+// WriteFileAtomic writes data to the named file, creating it with perm if
+// necessary; an existing file keeps its permissions. The data is written to
+// a temporary file next to it, which is synced and renamed over the file, so
+// readers see either the old content or all of the new one. This holds even
+// if the wrapped filesystem crashes midway, provided it can rename over an
+// existing file, as OS filesystems can; on those that cannot, the file is
+// removed before the rename, and a crash in between loses it.
+func (f *FileSystem) WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return f.writeFileAtomic(f.ctx, name, data, perm)
+}
+
+// WriteFileAtomic writes data to the named file, creating it with perm if
+// necessary; an existing file keeps its permissions. The data is written to
+// a temporary file next to it, which is synced and renamed over the file, so
+// readers see either the old content or all of the new one. This holds even
+// if the wrapped filesystem crashes midway, provided it can rename over an
+// existing file, as OS filesystems can; on those that cannot, the file is
+// removed before the rename, and a crash in between loses it.
+func (f *SymlinkFileSystem) WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return f.writeFileAtomic(f.ctx, name, data, perm)
+}
+
+func (c *core) writeFileAtomic(ctx context.Context, name string, data []byte, perm os.FileMode) (err error) {
+	defer c.audit(ctx, &err, AuditRecord{Op: "writefile", Path: name, Mode: &perm, Size: int64ptr(len(data))})
+	return c.replaceFile(ctx, name, data, perm, func(key string) error {
+		if c.shareModes && c.handles.denies(key, false, DenyWrite|DenyDelete) {
+			return &os.PathError{Op: "writefile", Path: name, Err: ErrSharingViolation}
+		}
+		return nil
+	})
+}
+
+// replaceFile stages data in a temporary file next to name, then, under the
+// filesystem write lock, calls check with the key of name and renames the
+// temporary file over name unless check fails. A new file is created with
+// perm; an existing file keeps its permissions.
+func (c *core) replaceFile(ctx context.Context, name string, data []byte, perm os.FileMode, check func(key string) error) error {
+	dir, file := path.Split(name)
+	tmp := path.Join(dir, fmt.Sprintf(".%s.tmp-%016x", file, rand.Uint64()))
+	if err := c.stage(ctx, "writefile", name, tmp, data, perm); err != nil {
+		return err
+	}
+	if err := c.acquireIdle(ctx, "writefile", false, name); err != nil {
+		c.discard(tmp)
+		return err
+	}
+	defer c.release(exclusive | mutating)
+	err := check(c.abs(name))
+	op := "create"
+	if err == nil {
+		if info, serr := c.base.Stat(name); serr == nil {
+			op = "writefile"
+			err = c.base.Chmod(tmp, info.Mode().Perm())
+		}
+	}
+	if err == nil {
+		err = c.rename(tmp, name)
+	}
+	if err != nil {
+		c.base.Remove(tmp)
+	}
+	return c.mutated(err, op, false, name)
+}
+
+// stage writes data to the new file tmp, which is to replace name, and
+// syncs it. The file is created under the filesystem write lock, but written
+// and synced under the read lock only, so readers are not held up by the
+// sync. Locks are taken as for a mutation of name. tmp is removed again if
+// staging fails.
+func (c *core) stage(ctx context.Context, op, name, tmp string, data []byte, perm os.FileMode) error {
+	if err := c.acquire(ctx, op, exclusive|mutating, name); err != nil {
+		return err
+	}
+	f, err := c.base.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	c.release(exclusive | mutating)
+	if err != nil {
+		return err
+	}
+	if err = c.acquire(ctx, op, mutating, name); err != nil {
+		f.Close()
+		c.discard(tmp)
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	c.release(mutating)
+	if err != nil {
+		c.discard(tmp)
+	}
+	return err
+}
+
+// discard removes the staged files names.
+func (c *core) discard(names ...string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, name := range names {
+		c.base.Remove(name)
+	}
+	c.invalidate(c.keys(names), false)
+}
+
+// rename renames oldpath over the file newpath. Some filesystems refuse to
+// rename over an existing file; newpath is removed first for them, which
+// readers cannot observe while the filesystem write lock is held, but which
+// is not atomic across a crash. The caller must hold the lock.
+func (c *core) rename(oldpath, newpath string) error {
+	err := c.base.Rename(oldpath, newpath)
+	if !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	if info, serr := c.base.Stat(newpath); serr != nil || info.IsDir() {
+		return err
+	}
+	if err := c.base.Remove(newpath); err != nil {
+		return err
+	}
+	return c.base.Rename(oldpath, newpath)
+}
@@ -0,0 +1,171 @@
+package lockfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// TestWriteFileAtomic tests that WriteFileAtomic creates and replaces files
+// without leaving temporary files behind.
+func TestWriteFileAtomic(t *testing.T) {
+	fsys := newShareFS(t)
+
+	if err := fsys.WriteFileAtomic("/dir/new.txt", []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileAtomic("/dir/new.txt", []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fsys.ReadFile("/dir/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second" {
+		t.Errorf("expected %q, got %q", "second", data)
+	}
+
+	entries, err := fsys.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected file.txt and new.txt only, got %v", entries)
+	}
+
+	// Existing files keep their permissions.
+	if err := fsys.Chmod("/dir/new.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFileAtomic("/dir/new.txt", []byte("third"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fsys.Stat("/dir/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 to be kept, got %v", info.Mode())
+	}
+
+	fsys.SetReadOnly(true)
+	if err := fsys.WriteFileAtomic("/dir/new.txt", nil, 0644); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("expected EROFS, got %v", err)
+	}
+}
+
+// TestWriteFileAtomicReaders tests that concurrent readers never see
+// partially written content.
+func TestWriteFileAtomicReaders(t *testing.T) {
+	fsys := newShareFS(t)
+	a, b := bytes.Repeat([]byte("a"), 4096), bytes.Repeat([]byte("b"), 8192)
+	if err := fsys.WriteFileAtomic("/dir/file.txt", a, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			data := a
+			if i%2 == 0 {
+				data = b
+			}
+			if err := fsys.WriteFileAtomic("/dir/file.txt", data, 0644); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				data, err := fsys.ReadFile("/dir/file.txt")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(data, a) && !bytes.Equal(data, b) {
+					t.Errorf("read partial content of length %d", len(data))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// blockingSyncFS blocks Sync on the files it opens until release is closed,
+// after closing started.
+type blockingSyncFS struct {
+	absfs.FileSystem
+	once             sync.Once
+	started, release chan struct{}
+}
+
+func (s *blockingSyncFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := s.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingSyncFile{File: f, fs: s}, nil
+}
+
+type blockingSyncFile struct {
+	absfs.File
+	fs *blockingSyncFS
+}
+
+func (f *blockingSyncFile) Sync() error {
+	f.fs.once.Do(func() { close(f.fs.started) })
+	<-f.fs.release
+	return f.File.Sync()
+}
+
+// TestWriteFileAtomicSyncUnlocked tests that readers proceed while
+// WriteFileAtomic syncs the new content.
+func TestWriteFileAtomicSyncUnlocked(t *testing.T) {
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &blockingSyncFS{FileSystem: mfs, started: make(chan struct{}), release: make(chan struct{})}
+	fsys, err := NewFS(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrote := make(chan error, 1)
+	go func() { wrote <- fsys.WriteFileAtomic("/file.txt", []byte("data"), 0644) }()
+	<-base.started
+	statted := make(chan error, 1)
+	go func() {
+		_, err := fsys.Stat("/")
+		statted <- err
+	}()
+	select {
+	case err := <-statted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stat blocked while WriteFileAtomic synced")
+	}
+	close(base.release)
+	if err := <-wrote; err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fsys.ReadFile("/file.txt"); err != nil || string(data) != "data" {
+		t.Errorf("ReadFile = %q, %v, want %q", data, err, "data")
+	}
+}